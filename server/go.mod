@@ -3,11 +3,14 @@ module chatserver
 go 1.22
 
 require (
+	github.com/ProtonMail/go-crypto v1.1.6
+	github.com/gorilla/websocket v1.5.3
 	golang.org/x/crypto v0.28.0
 	modernc.org/sqlite v1.28.0
 )
 
 require (
+	github.com/cloudflare/circl v1.3.7 // indirect
 	github.com/dustin/go-humanize v1.0.1 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51 // indirect
@@ -2,25 +2,53 @@ package main
 
 import (
 	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	_ "time/tzdata" // /tz and -tz work on images without zoneinfo (alpine)
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
 	_ "modernc.org/sqlite"
 )
 
 const (
 	addr       = ":5000" // TCP chat port
-	dbDSN      = "file:chat.db?_pragma=busy_timeout(5000)"
+	dbFile     = "chat.db"
 	bilalUser  = "bilal"
 	zohaibUser = "zohaib"
 
@@ -28,48 +56,532 @@ const (
 	reset  = "\x1b[0m"
 	green  = "\x1b[32m" // bilal
 	cyan   = "\x1b[36m" // zohaib
-	yellow = "\x1b[33m" // system
+	yellow = "\x1b[33m" // system (default)
+	gray   = "\x1b[90m" // echo of own messages
 )
 
+// colorNames maps the names accepted in flags to ANSI codes.
+var colorNames = map[string]string{
+	"black":   "\x1b[30m",
+	"red":     "\x1b[31m",
+	"green":   green,
+	"yellow":  yellow,
+	"blue":    "\x1b[34m",
+	"magenta": "\x1b[35m",
+	"cyan":    cyan,
+	"white":   "\x1b[37m",
+	"gray":    gray,
+}
+
+// palette is the resolved set of server-chosen colors.
+type palette struct {
+	system string // notices, errors and the pre-login ">> "
+	prompt string // the "> " prompt after login ("" = the user's own color)
+}
+
+var colors = palette{system: yellow}
+
+// resolveColor maps a color name to its ANSI code, falling back to def (with a
+// warning) for unknown names.
+func resolveColor(flagName, name, def string) string {
+	if name == "" { return def }
+	if c, ok := colorNames[strings.ToLower(name)]; ok { return c }
+	log.Printf("Unknown color %q for -%s; using the default\n", name, flagName)
+	return def
+}
+
 type userConn struct {
+	id   int64 // unique for the server's lifetime; what /sessions kill takes
 	name string
 	conn net.Conn
-	w    *bufio.Writer
+	w    *outbox
+	prefs map[string]string // user_prefs, loaded at attach; see pref
+	echo  bool              // echo own messages back (the echo pref)
+	bell  bool              // ring the terminal bell on incoming messages (the bell pref)
+	width int               // terminal columns (the width pref); 0 = don't wrap
+	draft string            // /draft save; gone when the connection is
+	missed []int64          // ids shown by this login's offline flush, for /missed
+	since time.Time         // when this session logged in
+}
+
+// userState is what belongs to a user rather than to one of their sessions. It
+// exists while they have any session and goes with the last one.
+type userState struct {
+	// last message sent, for -dedup-window
+	lastText string
+	lastAt   time.Time
+	lastSent time.Time // when the last message was stored, for /slowmode
+
+	// /afk state; cleared as soon as the user types anything
+	afk         bool
+	afkReason   string
+	afkNotified bool // the peer has already been told once
+}
+
+// options holds the command-line configuration.
+type options struct {
+	admin      string // username allowed to run admin commands ("" = nobody)
+	healthAddr string // HTTP listener for /healthz and /readyz ("" = disabled)
+	wsAddr     string // HTTP listener for the /chat WebSocket transport ("" = disabled)
+	signKey    []byte // HMAC key for messages.sig (nil = signing off)
+	noSummary  bool   // disable /summary (never send history to an LLM)
+	noSeed     bool   // don't create any users at startup
+	seedFrom   string // seed users from this JSON/CSV file instead of the defaults
+	maxLine    int    // longest input line accepted, in bytes
+	maxHashing int    // bcrypt operations allowed to run at once
+	geoIPPath  string // CSV of IP ranges to country codes for login logs ("" = off)
+	auditKeep  int    // login_audit rows kept, besides each user's last success (0 = all)
+	maxQueued  int    // undelivered messages kept per recipient (0 = unlimited)
+	dropOldest bool   // at maxQueued, drop the oldest instead of refusing the new one
+	backupDir  string // where /backup writes snapshots
+	exportDir  string // where /export writes transcripts
+	exportKey  string // armored PGP public key /export encrypts to ("" = plaintext)
+
+	proxyProtocol bool         // expect a PROXY protocol header from proxyFrom sources
+	proxyFrom     []*net.IPNet // trusted proxies (-proxy-from): PROXY headers and X-Forwarded-For
+
+	reserved map[string]bool // lowercased names register refuses (-reserved-names)
+
+	tz         *time.Location // default display timezone (users can override with /tz)
+	timeFormat string         // Go layout for message timestamps
+	showDate   bool           // prefix the date on timestamps not from today
+
+	dedupWindow  time.Duration // drop a message identical to the sender's previous one within this (0 = off)
+	ackRemind    time.Duration // how often to remind about unacknowledged /ack-request messages (0 = never)
+	loginTimeout time.Duration // disconnect clients that haven't logged in within this (0 = never)
+	maxLoginLine int           // longest line accepted before login, in bytes
+	idleTimeout  time.Duration // disconnect logged-in clients that send nothing for this long (0 = never)
+	idleWarning  time.Duration // warn this long before an idle disconnect (0 = no warning)
+	writeTimeout time.Duration // disconnect a client whose socket accepts nothing for this long (0 = never)
+
+	maxVideo int // active video sessions each user may be in at once (0 = unlimited)
+
+	deliveredWindow time.Duration // how long live-delivered ids wait to be marked (0 = immediately)
+	deliveredBatch  int           // mark early once this many ids are waiting
 }
 
 type chatServer struct {
-	db *sql.DB
+	db   *sql.DB
+	opts options
 
 	mu      sync.Mutex
-	clients map[string]*userConn // username -> active connection
+	clients map[string][]*userConn // username -> connected sessions, oldest first
+	users   map[string]*userState  // username -> state shared by their sessions
+	conns   map[*outbox]net.Conn   // every connection handle is running, logged in or not
+
+	// video requests: callee -> who asked for callee's camera, or for a call.
+	// Guarded by videoMu, not mu, so video coordination stays off the delivery path.
+	videoMu  sync.Mutex
+	videoReq map[string]videoRequest
+	// active video sessions: participant -> sids, so leaving can end the calls
+	// and -max-video-sessions can be enforced; guarded by mu
+	calls map[string][]string
+	// when each sid in calls was accepted, for reconcileCalls; guarded by mu
+	callStarted map[string]time.Time
+	// makes the sid for each accepted video request; generateSID unless a test
+	// swaps in something predictable
+	newSID func() string
+	// resolved display colors (users.color or the default), filled on first use
+	userColors map[string]string
+	// prompt formats (users.prompt or defaultPrompt), filled on first use
+	userPrompts map[string]string
+	// display timezones (the tz pref or -tz), filled on first use
+	userLocs map[string]*time.Location
+
+	// minimum gap between one user's messages, set by the admin with /slowmode
+	// and kept in server_settings (0 = off); guarded by mu
+	slowMode time.Duration
+
+	// offline auto-replies: username -> reply shown to senders while they're away
+	autoReply map[string]autoReply
+
+	// /ping-peer probes awaiting a /pong, by correlation id; guarded by mu
+	pings   map[string]*pendingPing
+	pingSeq int64
+
+	sessionSeq int64 // last userConn.id handed out; guarded by mu
+
+	geo []geoRange // from -geoip-db, sorted by start; nil = no country lookups
+
+	exportTo openpgp.EntityList // from -export-key; nil = /export writes plaintext
+
+	signedSince string // when signing was turned on (dbTimeLayout), for integrityMark
+
+	// banned_ips, checked as each connection is accepted
+	banMu sync.Mutex
+	bans  []*net.IPNet
+
+	hashSlots chan struct{} // one token per running bcrypt operation, capacity -max-bcrypt
+
+	// ids delivered live but not yet marked delivered=1; see markDelivered
+	deliveredMu sync.Mutex
+	delivered   []int64
+
+	ready atomic.Bool // set once the chat listener is accepting
+
+	// /drain or SIGUSR1: no new connections or messages, then exit
+	draining atomic.Bool
+	lnMu     sync.Mutex
+	ln       net.Listener // the chat listener serve is accepting on
+}
 
-	// video requests: callee -> requester (who asked for callee's camera)
-	videoReq map[string]string
+type autoReply struct {
+	text       string
+	persistent bool // survive the next login instead of being cleared
 }
 
 func main() {
 	log.SetFlags(log.LstdFlags|log.Lshortfile)
 
-	db, err := sql.Open("sqlite", dbDSN)
+	var opts options
+	flag.StringVar(&opts.admin, "admin", "", "username with admin rights")
+	flag.StringVar(&opts.healthAddr, "health-addr", ":5002", "HTTP address for /healthz and /readyz (empty to disable)")
+	flag.StringVar(&opts.wsAddr, "ws-addr", "", "HTTP address for the /chat WebSocket endpoint for browser clients, e.g. :5003 (empty to disable)")
+	systemColor := flag.String("system-color", "yellow", "color for system messages (black, red, green, yellow, blue, magenta, cyan, white, gray)")
+	flag.BoolVar(&opts.noSeed, "no-seed", false, "don't seed the default users")
+	flag.StringVar(&opts.seedFrom, "seed-from", "", "seed users from a JSON or CSV file of usernames and bcrypt hashes; SIGHUP re-reads it")
+	flag.IntVar(&opts.maxLine, "max-line-bytes", 64*1024, "longest input line accepted; longer lines disconnect the client")
+	flag.IntVar(&opts.maxLoginLine, "max-login-line-bytes", 512, "longest line accepted before login; longer lines disconnect the client")
+	flag.IntVar(&opts.maxHashing, "max-bcrypt", 4, "most password hashes checked or generated at once; logins beyond that wait briefly, then get \"server busy\"")
+	flag.DurationVar(&opts.idleTimeout, "idle-timeout", 0, "disconnect logged-in clients that send nothing for this long, e.g. 30m (0 = never)")
+	flag.DurationVar(&opts.idleWarning, "idle-warning", 60*time.Second, "with -idle-timeout, warn this long before disconnecting (0 = no warning)")
+	flag.DurationVar(&opts.writeTimeout, "write-timeout", 10*time.Second, "disconnect a client that stops reading for this long while output is waiting (0 = never)")
+	flag.IntVar(&opts.maxVideo, "max-video-sessions", 0, "video sessions a user may be in at once; /video is refused beyond that until one ends, which needs VIDEO_END_TOKEN to notice promptly (0 = unlimited)")
+	flag.DurationVar(&opts.loginTimeout, "login-timeout", 60*time.Second, "disconnect clients that haven't logged in within this long (0 = never)")
+	flag.BoolVar(&opts.proxyProtocol, "proxy-protocol", false, "read a PROXY protocol v1/v2 header naming the real client from -proxy-from sources (e.g. a TCP load balancer)")
+	proxyFrom := flag.String("proxy-from", "", "comma-separated addresses or CIDR ranges of trusted proxies; -proxy-protocol headers and X-Forwarded-For on -ws-addr are believed only from these")
+	flag.BoolVar(&opts.noSummary, "no-summary", false, "disable /summary so history is never sent to an external LLM")
+	tz := flag.String("tz", "", "IANA timezone for timestamps, e.g. Asia/Karachi (default: the server's local zone)")
+	flag.StringVar(&opts.timeFormat, "time-format", "15:04:05", "Go time layout for message timestamps")
+	flag.BoolVar(&opts.showDate, "show-date", false, "prefix the date on timestamps of messages not from today")
+	flag.DurationVar(&opts.dedupWindow, "dedup-window", 0, "suppress a message identical to the sender's previous one sent within this long, e.g. 2s (0 = off)")
+	flag.DurationVar(&opts.ackRemind, "ack-remind", 5*time.Minute, "remind both sides of an unacknowledged /ack-request this often (0 = never)")
+	flag.IntVar(&opts.maxQueued, "max-queued", 500, "most undelivered messages queued per recipient (0 for no limit)")
+	queueFull := flag.String("queue-full", "reject", "what to do at -max-queued: reject (refuse the new message) or drop-oldest")
+	flag.DurationVar(&opts.deliveredWindow, "delivered-window", 100*time.Millisecond, "batch delivered markers for this long before one UPDATE (0 to mark each message immediately)")
+	flag.IntVar(&opts.deliveredBatch, "delivered-batch", 100, "flush delivered markers early once this many are waiting")
+	reservedNames := flag.String("reserved-names", defaultReserved, "comma-separated usernames that can't be registered, matched case-insensitively")
+	flag.StringVar(&opts.backupDir, "backup-dir", "backups", "directory /backup writes database snapshots into")
+	flag.StringVar(&opts.exportDir, "export-dir", "exports", "directory /export writes transcripts into")
+	flag.StringVar(&opts.exportKey, "export-key", "", "armored PGP public key file; /export encrypts transcripts to it (default: plaintext)")
+	flag.StringVar(&opts.geoIPPath, "geoip-db", "", "CSV of start_ip,end_ip,country rows used to tag login logs with a country")
+	flag.IntVar(&opts.auditKeep, "login-audit-keep", 10000, "most recent login attempts kept for /logins; older ones are pruned, except each user's last successful login (0 = keep all)")
+	promptColor := flag.String("prompt-color", "", "color for the \"> \" prompt (default: the user's own color)")
+	var pragmas sqlitePragmas
+	flag.StringVar(&pragmas.journal, "sqlite-journal", "", "SQLite journal_mode: delete, truncate, persist, memory, wal or off (default: leave the database's mode)")
+	flag.StringVar(&pragmas.synchronous, "sqlite-synchronous", "", "SQLite synchronous: off, normal, full or extra (default: SQLite's, full)")
+	flag.IntVar(&pragmas.cacheSize, "sqlite-cache-size", 0, "SQLite cache_size: pages if positive, KiB if negative (0 = SQLite's default)")
+	flag.Parse()
+	if opts.maxHashing < 1 { log.Fatalf("-max-bcrypt: want at least 1, got %d", opts.maxHashing) }
+	if k := os.Getenv("CHAT_SIGNING_KEY"); k != "" { opts.signKey = []byte(k) }
+	opts.tz = time.Local
+	if *tz != "" {
+		loc, err := time.LoadLocation(*tz)
+		if err != nil { log.Fatalf("-tz: %v", err) }
+		opts.tz = loc
+	}
+	opts.reserved = parseReserved(*reservedNames)
+	for _, f := range strings.Split(*proxyFrom, ",") {
+		if f = strings.TrimSpace(f); f == "" { continue }
+		n, err := parseBan(f)
+		if err != nil { log.Fatalf("-proxy-from: %v", err) }
+		opts.proxyFrom = append(opts.proxyFrom, n)
+	}
+	if opts.proxyProtocol && len(opts.proxyFrom) == 0 { log.Fatal("-proxy-protocol needs -proxy-from with the load balancer's addresses") }
+	switch *queueFull {
+	case "reject":
+	case "drop-oldest": opts.dropOldest = true
+	default: log.Fatalf("-queue-full: want reject or drop-oldest, got %q", *queueFull)
+	}
+	colors = palette{
+		system: resolveColor("system-color", *systemColor, yellow),
+		prompt: resolveColor("prompt-color", *promptColor, ""),
+	}
+
+	dsn, err := pragmas.dsn()
+	if err != nil { log.Fatal(err) }
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil { log.Fatal(err) }
+	s, err := newServer(db, opts)
 	if err != nil { log.Fatal(err) }
-	if err := migrate(db); err != nil { log.Fatal(err) }
-	if err := seedUsers(db); err != nil { log.Fatal(err) }
 
-	s := &chatServer{
-		db:       db,
-		clients:  make(map[string]*userConn),
-		videoReq: make(map[string]string),
+	if opts.healthAddr != "" {
+		go s.serveHealth(opts.healthAddr)
+	}
+	if opts.wsAddr != "" {
+		go s.serveWS(opts.wsAddr)
+	}
+	go s.shutdownOnSignal()
+	go s.drainOnSignal()
+	if opts.seedFrom != "" {
+		go s.reseedOnSignal()
 	}
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil { log.Fatal(err) }
 	log.Println("Chat server listening on", addr)
+	err = s.serve(ln)
+	if !s.draining.Load() { log.Fatal(err) }
+	s.waitDrained(drainWait)
+	s.flushDelivered()
+	_ = s.db.Close()
+	log.Println("Drained; exiting")
+}
+
+// newServer migrates db, seeds it as opts says and returns a server ready to
+// serve. main passes chat.db; any SQLite handle works, e.g. an in-memory
+// "file::memory:?cache=shared" one for an in-process server.
+func newServer(db *sql.DB, opts options) (*chatServer, error) {
+	geo, err := loadGeoIP(opts.geoIPPath)
+	if err != nil { return nil, err }
+	exportTo, err := loadExportKey(opts.exportKey)
+	if err != nil { return nil, err }
+	if err := migrate(db); err != nil { return nil, err }
+	bans, err := loadBans(db)
+	if err != nil { return nil, err }
+	signedSince, err := markSigning(db, opts.signKey != nil)
+	if err != nil { return nil, err }
+	slow, err := loadSlowMode(db)
+	if err != nil { return nil, err }
+	switch {
+	case opts.noSeed:
+	case opts.seedFrom != "":
+		users, err := loadSeedFile(opts.seedFrom)
+		if err != nil { return nil, err }
+		if _, err := seedFromFile(db, users, false); err != nil { return nil, err }
+	default:
+		if err := seedUsers(db); err != nil { return nil, err }
+	}
+	// fields with no usable zero value, for callers that don't go through flags
+	if opts.maxLine <= 0 { opts.maxLine = 64 * 1024 }
+	if opts.maxLoginLine <= 0 { opts.maxLoginLine = 512 }
+	if opts.maxHashing <= 0 { opts.maxHashing = 4 }
+	if opts.timeFormat == "" { opts.timeFormat = "15:04:05" }
+	if opts.tz == nil { opts.tz = time.Local }
+	if opts.reserved == nil { opts.reserved = parseReserved(defaultReserved) }
 
+	return &chatServer{
+		db:          db,
+		opts:        opts,
+		clients:     make(map[string][]*userConn),
+		conns:       make(map[*outbox]net.Conn),
+		users:       make(map[string]*userState),
+		videoReq:    make(map[string]videoRequest),
+		calls:       make(map[string][]string),
+		callStarted: make(map[string]time.Time),
+		newSID:      generateSID,
+		userColors:  make(map[string]string),
+		userPrompts: make(map[string]string),
+		userLocs:    make(map[string]*time.Location),
+		autoReply:   make(map[string]autoReply),
+		pings:       make(map[string]*pendingPing),
+		geo:         geo,
+		exportTo:    exportTo,
+		bans:        bans,
+		signedSince: signedSince,
+		slowMode:    slow,
+		hashSlots:   make(chan struct{}, opts.maxHashing),
+	}, nil
+}
+
+// serve starts the server's background work and runs a session for each
+// connection accepted on ln, which may be any listener (a TCP port, or an
+// in-memory one). It returns once ln is closed, stopping the background work.
+func (s *chatServer) serve(ln net.Listener) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	if s.opts.deliveredWindow > 0 {
+		go s.flushDeliveredEvery(s.opts.deliveredWindow, stop)
+	}
+	if s.opts.ackRemind > 0 {
+		go s.remindAcks(s.opts.ackRemind, stop)
+	}
+	s.lnMu.Lock(); s.ln = ln; s.lnMu.Unlock()
+	s.ready.Store(true)
 	for {
 		c, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) { return err }
 		if err != nil { continue }
-		go s.handle(c)
+		go s.accept(c)
+	}
+}
+
+// accept resolves the real client of a connection from a trusted proxy, then
+// drops banned addresses before handle sends anything.
+func (s *chatServer) accept(c net.Conn) {
+	if s.opts.proxyProtocol && s.fromProxy(c.RemoteAddr()) {
+		pc, err := readProxyHeader(c)
+		if err != nil {
+			log.Printf("PROXY header from %s: %v; disconnecting\n", c.RemoteAddr(), err)
+			_ = c.Close()
+			return
+		}
+		c = pc
+	}
+	if s.isBanned(c.RemoteAddr()) { _ = c.Close(); return }
+	s.handle(c)
+}
+
+// serveHealth exposes liveness (/healthz: the DB answers) and readiness
+// (/readyz: the DB answers and the chat listener is up) for probes.
+func (s *chatServer) serveHealth(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.pingDB(r.Context()); err != nil {
+			http.Error(w, "db: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not accepting connections yet", http.StatusServiceUnavailable)
+			return
+		}
+		if err := s.pingDB(r.Context()); err != nil {
+			http.Error(w, "db: "+err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	log.Println("Health checks listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// ===== WebSocket transport =====
+// -ws-addr serves /chat, which runs the same session as the TCP listener over a
+// WebSocket, for browser clients. Every frame is a JSON object:
+//
+//	client -> server  {"type":"line","text":"login bilal ..."}   one input line
+//	server -> client  {"type":"output","text":"..."}             terminal output
+//
+// Output text is exactly what a TCP client receives, ANSI colors and prompts
+// included (a browser terminal such as xterm.js can render it as is), minus the
+// telnet negotiation bytes. /compress isn't offered since frames are already
+// delimited.
+
+var wsUpgrader = websocket.Upgrader{
+	// auth is in-band (the login line), so there's no ambient credential for a
+	// cross-site page to ride on
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func (s *chatServer) serveWS(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/chat", func(w http.ResponseWriter, r *http.Request) {
+		if s.draining.Load() { http.Error(w, "server is restarting", http.StatusServiceUnavailable); return }
+		remote := s.wsClient(r)
+		if s.isBanned(remote) { http.Error(w, "forbidden", http.StatusForbidden); return }
+		ws, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil { return }
+		ws.SetReadLimit(int64(s.opts.maxLine) + wsFrameOverhead)
+		s.handle(&wsConn{ws: ws, remote: remote})
+	})
+	log.Println("WebSocket chat listening on", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
+
+// wsFrameOverhead is what a "line" frame may carry beyond -max-line-bytes:
+// the JSON wrapper and escaping. Bigger frames close the connection before
+// they're buffered, as an over-long line does on the raw TCP port.
+const wsFrameOverhead = 1024
+
+// wsConn adapts a WebSocket to the net.Conn handle expects: "line" frames
+// become newline-terminated input, and writes go out as "output" frames.
+type wsConn struct {
+	ws     *websocket.Conn
+	in     io.Reader // rest of the current input frame
+	remote net.Addr  // the client, past any trusted proxies (see wsClient)
+
+	mu      sync.Mutex
+	partial []byte // trailing bytes of a UTF-8 sequence split across writes
+}
+
+type wsFrame struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.in != nil {
+			if n, _ := c.in.Read(p); n > 0 { return n, nil }
+		}
+		_, data, err := c.ws.ReadMessage()
+		if err != nil { return 0, err }
+		var f wsFrame
+		if json.Unmarshal(data, &f) != nil || f.Type != "line" { continue } // ignore anything else
+		c.in = strings.NewReader(f.Text + "\n")
+	}
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data := append(c.partial, p...)
+	// hold back an incomplete trailing rune; the outbox flushes in buffer-sized chunks
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) { cut = i }
+			break
+		}
+	}
+	c.partial = append([]byte(nil), data[cut:]...)
+	text := strings.NewReplacer(telnetEchoOff, "", telnetEchoOn, "").Replace(string(data[:cut]))
+	if text == "" { return len(p), nil }
+	if err := c.ws.WriteJSON(wsFrame{Type: "output", Text: text}); err != nil { return 0, err }
+	return len(p), nil
+}
+
+func (c *wsConn) Close() error                       { return c.ws.Close() }
+func (c *wsConn) LocalAddr() net.Addr                { return c.ws.LocalAddr() }
+func (c *wsConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *wsConn) SetDeadline(t time.Time) error      { return c.ws.UnderlyingConn().SetDeadline(t) }
+func (c *wsConn) SetReadDeadline(t time.Time) error  { return c.ws.SetReadDeadline(t) }
+func (c *wsConn) SetWriteDeadline(t time.Time) error { return c.ws.SetWriteDeadline(t) }
+
+// sqlitePragmas are the -sqlite-* flags. They go in the DSN rather than through
+// one db.Exec("PRAGMA ...") because synchronous and cache_size are per
+// connection, and database/sql opens several.
+//
+// Durability tradeoffs: journal_mode=wal lets /history and other reads run
+// while a message is being written, instead of waiting on the lock, and adds
+// chat.db-wal and chat.db-shm beside the database (/backup handles them). With
+// wal, synchronous=normal is still crash-safe for the database but a power cut
+// can lose the last few committed messages; full syncs every commit, and off
+// leaves even the database at the OS's mercy. journal_mode=memory or off can
+// corrupt the database if the process dies mid-write.
+type sqlitePragmas struct {
+	journal     string
+	synchronous string
+	cacheSize   int
+}
+
+func (p sqlitePragmas) dsn() (string, error) {
+	q := url.Values{"_pragma": {"busy_timeout(5000)"}}
+	if p.journal != "" {
+		switch strings.ToLower(p.journal) {
+		case "delete", "truncate", "persist", "memory", "wal", "off":
+		default: return "", fmt.Errorf("-sqlite-journal: want delete, truncate, persist, memory, wal or off, got %q", p.journal)
+		}
+		q.Add("_pragma", "journal_mode("+strings.ToLower(p.journal)+")")
+	}
+	if p.synchronous != "" {
+		switch strings.ToLower(p.synchronous) {
+		case "off", "normal", "full", "extra":
+		default: return "", fmt.Errorf("-sqlite-synchronous: want off, normal, full or extra, got %q", p.synchronous)
+		}
+		q.Add("_pragma", "synchronous("+strings.ToLower(p.synchronous)+")")
 	}
+	if p.cacheSize != 0 { q.Add("_pragma", fmt.Sprintf("cache_size(%d)", p.cacheSize)) }
+	return "file:" + dbFile + "?" + q.Encode(), nil
+}
+
+func (s *chatServer) pingDB(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return s.db.PingContext(ctx)
 }
 
 func migrate(db *sql.DB) error {
@@ -78,6 +590,10 @@ CREATE TABLE IF NOT EXISTS users(
   username TEXT PRIMARY KEY,
   password_hash BLOB NOT NULL
 );
+CREATE TABLE IF NOT EXISTS deleted_users(
+  username TEXT PRIMARY KEY,
+  deleted_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
 CREATE TABLE IF NOT EXISTS messages(
   id INTEGER PRIMARY KEY AUTOINCREMENT,
   sender TEXT NOT NULL,
@@ -88,7 +604,196 @@ CREATE TABLE IF NOT EXISTS messages(
 );
 CREATE INDEX IF NOT EXISTS idx_messages_recipient_delivered
   ON messages(recipient, delivered, ts);
+CREATE TABLE IF NOT EXISTS invites(
+  code TEXT PRIMARY KEY,
+  created_by TEXT NOT NULL,
+  expires_at DATETIME NOT NULL
+);
+CREATE TABLE IF NOT EXISTS message_edits(
+  message_id INTEGER NOT NULL,
+  old_text TEXT NOT NULL,
+  edited_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS idx_message_edits_message
+  ON message_edits(message_id, edited_at);
+CREATE TABLE IF NOT EXISTS login_ips(
+  username TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  first_seen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  last_seen DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY(username, ip)
+);
+CREATE TABLE IF NOT EXISTS blocks(
+  blocker TEXT NOT NULL,
+  blocked TEXT NOT NULL,
+  PRIMARY KEY(blocker, blocked)
+);
+CREATE TABLE IF NOT EXISTS login_audit(
+  username TEXT NOT NULL,
+  remote_addr TEXT NOT NULL,
+  ts DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  success INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS video_sessions(
+  sid TEXT PRIMARY KEY,
+  sender TEXT NOT NULL,
+  viewer TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  ended_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS user_prefs(
+  username TEXT NOT NULL,
+  key TEXT NOT NULL,
+  value TEXT NOT NULL,
+  PRIMARY KEY(username, key)
+);
+CREATE TABLE IF NOT EXISTS threads(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  topic TEXT NOT NULL,
+  creator TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  closed_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS polls(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  creator TEXT NOT NULL,
+  question TEXT NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  closed_at DATETIME
+);
+CREATE TABLE IF NOT EXISTS votes(
+  poll_id INTEGER NOT NULL,
+  voter TEXT NOT NULL,
+  vote TEXT NOT NULL,
+  voted_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY(poll_id, voter)
+);
+CREATE TABLE IF NOT EXISTS banned_ips(
+  cidr TEXT PRIMARY KEY,
+  banned_by TEXT NOT NULL,
+  banned_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS snippets(
+  user TEXT NOT NULL,
+  name TEXT NOT NULL,
+  text TEXT NOT NULL,
+  PRIMARY KEY(user, name)
+);
+CREATE TABLE IF NOT EXISTS aliases(
+  user TEXT NOT NULL,
+  name TEXT NOT NULL,
+  target TEXT NOT NULL,
+  PRIMARY KEY(user, name)
+);
+CREATE TABLE IF NOT EXISTS read_marks(
+  user TEXT PRIMARY KEY,
+  msg_id INTEGER NOT NULL,
+  marked_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS server_settings(
+  key TEXT PRIMARY KEY,
+  value TEXT NOT NULL
+);
 `)
+	if err != nil { return err }
+	// columns added after the initial schema
+	if err := addColumn(db, "messages", "is_action", "INTEGER NOT NULL DEFAULT 0"); err != nil { return err }
+	if err := addColumn(db, "messages", "kind", "TEXT NOT NULL DEFAULT 'chat'"); err != nil { return err }
+	if err := addColumn(db, "messages", "sig", "TEXT"); err != nil { return err }
+	if err := addColumn(db, "users", "color", "TEXT"); err != nil { return err }
+	if err := addColumn(db, "messages", "pinned", "INTEGER NOT NULL DEFAULT 0"); err != nil { return err }
+	if err := addColumn(db, "users", "prompt", "TEXT"); err != nil { return err }
+	if err := addColumn(db, "users", "no_video", "INTEGER NOT NULL DEFAULT 0"); err != nil { return err }
+	if err := addColumn(db, "users", "tz", "TEXT"); err != nil { return err }
+	if err := addColumn(db, "users", "status", "TEXT"); err != nil { return err }
+	if err := addColumn(db, "messages", "ack_required", "INTEGER NOT NULL DEFAULT 0"); err != nil { return err }
+	if err := addColumn(db, "messages", "acked_at", "DATETIME"); err != nil { return err }
+	if err := addColumn(db, "messages", "forwarded_from", "INTEGER"); err != nil { return err }
+	if err := addColumn(db, "messages", "reply_to", "INTEGER"); err != nil { return err }
+	if err := addColumn(db, "messages", "thread_id", "INTEGER"); err != nil { return err }
+	if err := addColumn(db, "video_sessions", "two_way", "INTEGER NOT NULL DEFAULT 0"); err != nil { return err }
+	// users.tz predates user_prefs; carry it over once, clearing it so a tz
+	// later reset with /tz isn't brought back on the next start
+	if err := moveTZPrefs(db); err != nil { return err }
+	_, err = db.Exec(`UPDATE messages SET kind='action' WHERE is_action=1 AND kind='chat'`)
+	return err
+}
+
+func moveTZPrefs(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT OR IGNORE INTO user_prefs(username, key, value) SELECT username, 'tz', tz FROM users WHERE tz IS NOT NULL`); err != nil { return err }
+	if _, err := tx.Exec(`UPDATE users SET tz=NULL WHERE tz IS NOT NULL`); err != nil { return err }
+	return tx.Commit()
+}
+
+// dbTimeLayout matches SQLite's CURRENT_TIMESTAMP (UTC).
+const dbTimeLayout = "2006-01-02 15:04:05"
+
+// signMessage computes messages.sig: "v2:" and an HMAC-SHA256 over the
+// length-prefixed sender, recipient, text, ts, kind and is_action, so edits
+// made directly to chat.db are detectable.
+func signMessage(key []byte, sender, recipient, text, ts, kind string, action bool) string {
+	return "v2:" + hmacFields(key, sender, recipient, text, ts, kind, strconv.FormatBool(action))
+}
+
+// hmacFields is the HMAC-SHA256 of fields, each length-prefixed, in hex. Rows
+// signed before kind and is_action were covered hold it over the first four
+// alone, with no "v2:".
+func hmacFields(key []byte, fields ...string) string {
+	m := hmac.New(sha256.New, key)
+	for _, f := range fields {
+		fmt.Fprintf(m, "%d:%s", len(f), f)
+	}
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+// markSigning records in server_settings when signing was turned on, keeping
+// the first time across restarts, and returns it; turning signing off forgets it.
+func markSigning(db *sql.DB, on bool) (string, error) {
+	if !on {
+		_, err := db.Exec(`DELETE FROM server_settings WHERE key='signing_since'`)
+		return "", err
+	}
+	if _, err := db.Exec(`INSERT OR IGNORE INTO server_settings(key, value) VALUES('signing_since', ?)`, time.Now().UTC().Format(dbTimeLayout)); err != nil { return "", err }
+	var since string
+	err := db.QueryRow(`SELECT value FROM server_settings WHERE key='signing_since'`).Scan(&since)
+	return since, err
+}
+
+// integrityMark returns a warning prefix when signing is on and a row's stored
+// signature doesn't match its content. Rows written before signing was enabled
+// have no signature and are shown as-is; an unsigned row from since then has
+// had its signature stripped and is flagged.
+func (s *chatServer) integrityMark(sender, recipient, text, ts, kind string, action bool, sig sql.NullString) string {
+	if s.opts.signKey == nil { return "" }
+	if !sig.Valid {
+		if ts >= s.signedSince { return "[integrity warning] " }
+		return ""
+	}
+	want := hmacFields(s.opts.signKey, sender, recipient, text, ts)
+	if strings.HasPrefix(sig.String, "v2:") { want = signMessage(s.opts.signKey, sender, recipient, text, ts, kind, action) }
+	if hmac.Equal([]byte(want), []byte(sig.String)) { return "" }
+	return "[integrity warning] "
+}
+
+// Message kinds stored in messages.kind.
+const (
+	kindChat   = "chat"
+	kindAction = "action" // /me
+	kindSystem = "system" // join/leave and other server notices
+)
+
+// addColumn runs ALTER TABLE ... ADD COLUMN unless the column already exists,
+// so older chat.db files pick up new fields on startup.
+func addColumn(db *sql.DB, table, column, decl string) error {
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM pragma_table_info(?) WHERE name=?`, table, column).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 { return nil }
+	_, err := db.Exec(`ALTER TABLE ` + table + ` ADD COLUMN ` + column + ` ` + decl)
 	return err
 }
 
@@ -100,8 +805,8 @@ func seedUsers(db *sql.DB) error {
 	}
 	for _, d := range defaults {
 		var exists int
-		_ = db.QueryRow(`SELECT 1 FROM users WHERE username=?`, d.name).Scan(&exists)
-		if exists == 1 { continue }
+		_ = db.QueryRow(`SELECT 1 FROM users WHERE username=? UNION ALL SELECT 1 FROM deleted_users WHERE username=?`, d.name, d.name).Scan(&exists)
+		if exists == 1 { continue } // never bring back a deleted account with its well-known password
 		h, _ := bcrypt.GenerateFromPassword([]byte(d.pass), bcrypt.DefaultCost)
 		if _, err := db.Exec(`INSERT INTO users(username, password_hash) VALUES(?,?)`, d.name, h); err != nil {
 			return err
@@ -111,240 +816,3742 @@ func seedUsers(db *sql.DB) error {
 	return nil
 }
 
-func (s *chatServer) handle(conn net.Conn) {
-	defer conn.Close()
-	r := bufio.NewScanner(conn)
-	w := bufio.NewWriter(conn)
+// seedUser is one entry of a -seed-from file. The file holds bcrypt hashes, never
+// plaintext passwords:
+//
+//	JSON: [{"username": "bilal", "password_hash": "$2a$10$..."}]
+//	CSV:  bilal,$2a$10$...
+type seedUser struct {
+	Username     string `json:"username"`
+	PasswordHash string `json:"password_hash"`
+}
+
+func loadSeedFile(path string) ([]seedUser, error) {
+	f, err := os.Open(path)
+	if err != nil { return nil, err }
+	defer f.Close()
+
+	var users []seedUser
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.NewDecoder(f).Decode(&users); err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+	} else {
+		cr := csv.NewReader(f)
+		cr.FieldsPerRecord = 2
+		cr.Comment = '#'
+		recs, err := cr.ReadAll()
+		if err != nil { return nil, fmt.Errorf("%s: %w", path, err) }
+		for _, r := range recs {
+			users = append(users, seedUser{Username: strings.TrimSpace(r[0]), PasswordHash: strings.TrimSpace(r[1])})
+		}
+	}
+	for _, u := range users {
+		if _, err := bcrypt.Cost([]byte(u.PasswordHash)); err != nil {
+			return nil, fmt.Errorf("%s: user %q: not a bcrypt hash", path, u.Username)
+		}
+	}
+	return users, nil
+}
+
+// seedFromFile inserts the file's users that don't exist yet and, with
+// update, replaces the hash of existing ones whose hash in the file differs.
+// Only the chat's two usernames can log in, so anything else is skipped. It
+// returns how many users were added or updated.
+func seedFromFile(db *sql.DB, users []seedUser, update bool) (int, error) {
+	changed := 0
+	for _, u := range users {
+		if !allowedUser(u.Username) {
+			log.Printf("Seed file: skipping %q (only bilal and zohaib can log in)\n", u.Username)
+			continue
+		}
+		var hash []byte
+		err := db.QueryRow(`SELECT password_hash FROM users WHERE username=?`, u.Username).Scan(&hash)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			var deleted int
+			_ = db.QueryRow(`SELECT 1 FROM deleted_users WHERE username=?`, u.Username).Scan(&deleted)
+			if deleted == 1 {
+				log.Printf("Seed file: skipping %s (account was deleted; an invite can restore it)\n", u.Username)
+				continue
+			}
+			if _, err := db.Exec(`INSERT INTO users(username, password_hash) VALUES(?,?)`, u.Username, []byte(u.PasswordHash)); err != nil { return changed, err }
+			log.Printf("Seeded user %s from seed file\n", u.Username)
+			changed++
+		case err != nil:
+			return changed, err
+		case update && string(hash) != u.PasswordHash:
+			if _, err := db.Exec(`UPDATE users SET password_hash=? WHERE username=?`, []byte(u.PasswordHash), u.Username); err != nil { return changed, err }
+			log.Printf("Updated password of %s from seed file\n", u.Username)
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// reseedOnSignal re-reads -seed-from on every SIGHUP, so accounts can be added
+// or re-keyed without a restart. A bad file is logged and leaves users as they are.
+func (s *chatServer) reseedOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		users, err := loadSeedFile(s.opts.seedFrom)
+		if err != nil { log.Printf("SIGHUP: not reseeding: %v\n", err); continue }
+		n, err := seedFromFile(s.db, users, true)
+		if err != nil { log.Printf("SIGHUP: reseeding stopped after %d change(s): %v\n", n, err); continue }
+		log.Printf("SIGHUP: reseeded from %s, %d user(s) added or updated\n", s.opts.seedFrom, n)
+	}
+}
+
+// drainWait bounds how long a drained server waits for sessions to close.
+const drainWait = 10 * time.Second
+
+// drain quiesces the server for a restart: it refuses new connections and
+// messages, stores the pending delivered markers, tells every session to
+// reconnect and closes it once its queued output is written. Closing the
+// listener makes serve return, and main exits once the sessions are gone.
+// It reports false if a drain was already under way.
+func (s *chatServer) drain(why string) bool {
+	if s.draining.Swap(true) { return false }
+	log.Printf("Draining (%s)\n", why)
+	s.ready.Store(false)
+	s.lnMu.Lock(); ln := s.ln; s.lnMu.Unlock()
+	if ln != nil { _ = ln.Close() }
+	s.flushDelivered()
+	s.mu.Lock()
+	var all []*userConn
+	for _, ucs := range s.clients { all = append(all, ucs...) }
+	s.mu.Unlock()
+	for _, uc := range all {
+		s.notifySystem(uc, "Server restarting, please reconnect in a moment.")
+		uc.w.close()
+	}
+	return true
+}
+
+// waitDrained waits up to max for every session to log out.
+func (s *chatServer) waitDrained(max time.Duration) {
+	for deadline := time.Now().Add(max); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+		s.mu.Lock(); n := len(s.clients); s.mu.Unlock()
+		if n == 0 { return }
+	}
+}
+
+func (s *chatServer) drainOnSignal() {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	for range usr1 { s.drain("SIGUSR1") }
+}
+
+// startLoginTimer bounds the pre-login phase to -login-timeout with a read
+// deadline; handle clears it on a successful login.
+func (s *chatServer) startLoginTimer(conn net.Conn) {
+	if s.opts.loginTimeout > 0 { _ = conn.SetReadDeadline(time.Now().Add(s.opts.loginTimeout)) }
+}
+
+// idleWatch enforces -idle-timeout on a logged-in session in two stages: a
+// warning -idle-warning before the end, then the read deadline itself. Any
+// input line pushes both back. Methods are no-ops on nil (the timeout off).
+type idleWatch struct {
+	s    *chatServer
+	conn net.Conn
+	warn *time.Timer // nil when -idle-warning is 0 or not shorter than the timeout
+}
+
+func (s *chatServer) watchIdle(conn net.Conn, username string, w *outbox) *idleWatch {
+	if s.opts.idleTimeout <= 0 { return nil }
+	iw := &idleWatch{s: s, conn: conn}
+	if lead := s.opts.idleWarning; lead > 0 && lead < s.opts.idleTimeout {
+		iw.warn = time.AfterFunc(s.opts.idleTimeout-lead, func() {
+			if uc := s.session(username, w); uc != nil {
+				s.notifySystem(uc, fmt.Sprintf("You will be disconnected in %s due to inactivity. Type anything to stay.", lead))
+			}
+		})
+	}
+	return iw
+}
+
+// touch restarts both stages from now.
+func (iw *idleWatch) touch() {
+	if iw == nil { return }
+	_ = iw.conn.SetReadDeadline(time.Now().Add(iw.s.opts.idleTimeout))
+	if iw.warn != nil { iw.warn.Reset(iw.s.opts.idleTimeout - iw.s.opts.idleWarning) }
+}
+
+func (iw *idleWatch) stop() {
+	if iw == nil { return }
+	if iw.warn != nil { iw.warn.Stop() }
+	_ = iw.conn.SetReadDeadline(time.Time{})
+}
+
+// newScanner reads lines from src, up to -max-line-bytes each, or only
+// -max-login-line-bytes while loggedIn reports false: the unauthenticated side
+// has no reason to send more than a login line. A longer line before login
+// ends the scan with errInputTooLong.
+func (s *chatServer) newScanner(src io.Reader, loggedIn func() bool) *bufio.Scanner {
+	r := bufio.NewScanner(src)
+	r.Buffer(make([]byte, 0, min(4096, s.opts.maxLine)), s.opts.maxLine)
+	r.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		adv, tok, err := bufio.ScanLines(data, atEOF)
+		if loggedIn() { return adv, tok, err }
+		if len(tok) > s.opts.maxLoginLine || (tok == nil && len(data) > s.opts.maxLoginLine) { return 0, nil, errInputTooLong }
+		return adv, tok, err
+	})
+	return r
+}
+
+var errInputTooLong = errors.New("input too long")
 
-	writeLine(w, yellow, "Welcome to VM Chat!")
-	writeLine(w, yellow, "Login with:  login <username> <password>")
-	writeLine(w, yellow, "Users: bilal, zohaib")
-	writeLine(w, yellow, "Commands: /quit, /history [N], /video, /acceptvideo, /declinevideo")
-	write(w, yellow, ">> ")
+// setCaps applies a pre-login "caps <name>=<value> ..." line, a client
+// declaring what it can render. These last for the connection, across
+// /logout. The only one so far is colors=on|off.
+func setCaps(w *outbox, caps []string) error {
+	for _, c := range caps {
+		k, v, _ := strings.Cut(c, "=")
+		switch {
+		case k == "colors" && (v == "on" || v == "off"):
+			w.plain.Store(v == "off")
+		default:
+			return fmt.Errorf("Unknown capability %q. Usage: caps colors=on|off", c)
+		}
+	}
+	return nil
+}
 
+func (s *chatServer) handle(conn net.Conn) {
+	w := newOutbox(conn, s.opts.writeTimeout)
+	defer w.close() // drains queued output, then closes conn
+	s.mu.Lock(); s.conns[w] = conn; s.mu.Unlock()
+	defer func() { s.mu.Lock(); delete(s.conns, w); s.mu.Unlock() }()
 	var username string
+	r := s.newScanner(conn, func() bool { return username != "" })
+	s.startLoginTimer(conn)
+
+	systemLine(w, "Welcome to VM Chat!")
+	systemLine(w, "Login with:  login <username> <password>   (or: login <username>, then the password)")
+	systemLine(w, "Users: bilal, zohaib")
+	systemLine(w, "Have an invite?  register <username> <password> <invite-code>")
+	systemLine(w, "After login, type /help for the list of commands.")
+	systemLine(w, "Clients without ANSI colors: send  caps colors=off  first.")
+	write(w, colors.system, ">> ")
+
+	pendingUser := ""      // "login <username>" seen, next line is the password
+	confirmDelete := false // /delete-account verified, waiting for keep/purge
+	compressed := false    // /compress on: both directions are raw DEFLATE from here on
+	var idle *idleWatch    // -idle-timeout, from login to logout
+	defer func() { idle.stop() }()
 	for r.Scan() {
-		line := strings.TrimSpace(r.Text())
+		idle.touch()
+		raw := stripTelnet(r.Text())
+		line := strings.TrimSpace(raw)
 		if username == "" {
-			if strings.HasPrefix(line, "login ") {
-				parts := strings.Fields(line)
-				if len(parts) < 3 {
-					writeLine(w, yellow, "Usage: login <username> <password>")
-					write(w, yellow, ">> ")
+			u, p, ok := "", "", false
+			if pendingUser != "" {
+				u, p, ok = pendingUser, raw, true
+				pendingUser = ""
+				w.send(telnetEchoOn)
+				systemLine(w, "") // the client didn't echo the newline either
+			} else if _, isLogin := cutWord(line, "login"); isLogin {
+				if u, p, ok = parseLogin(raw); !ok {
+					if f := strings.Fields(line); len(f) == 2 {
+						// two-step login: ask telnet clients to stop echoing the password
+						pendingUser = f[1]
+						write(w, colors.system, "Password: ")
+						w.send(telnetEchoOff)
+						continue
+					}
+					errorLine(w, "Usage: login <username> <password>")
+					write(w, colors.system, ">> ")
 					continue
 				}
-				u, p := parts[1], strings.Join(parts[2:], " ")
-				if u != bilalUser && u != zohaibUser {
-					writeLine(w, yellow, "Only bilal and zohaib are allowed.")
-					write(w, yellow, ">> ")
+			}
+			if ok {
+				if !allowedUser(u) {
+					s.auditLogin(u, conn.RemoteAddr(), false)
+					systemLine(w, "Only bilal and zohaib are allowed.")
+					write(w, colors.system, ">> ")
 					continue
 				}
-				if !s.checkPassword(u, p) {
-					writeLine(w, yellow, "Invalid credentials.")
-					write(w, yellow, ">> ")
+				if err := s.checkPassword(u, p); err == errServerBusy {
+					errorLine(w, "Server busy, retry.")
+					write(w, colors.system, ">> ")
+					continue
+				} else if err != nil {
+					s.auditLogin(u, conn.RemoteAddr(), false)
+					errorLine(w, "Invalid credentials.")
+					write(w, colors.system, ">> ")
 					continue
 				}
 				username = u
-				s.attach(username, conn, w)
-				writeLine(w, yellow, "Logged in as "+username+". Type your message. /quit to exit.")
-				s.deliverUndelivered(username)
-				s.systemBroadcast(username, fmt.Sprintf("%s joined.", username))
-				writePrompt(w, username)
+				_ = conn.SetReadDeadline(time.Time{})
+				idle = s.watchIdle(conn, username, w)
+				idle.touch()
+				s.auditLogin(username, conn.RemoteAddr(), true)
+				uc, first := s.attach(username, conn, w)
+				go s.logLogin(username, conn.RemoteAddr())
+				systemLine(w, "Logged in as "+username+". Type your message. /quit to exit.")
+				systemLine(w, s.timeLine(username, time.Now()))
+				if n := len(s.sessions(username)); n > 1 { systemLine(w, fmt.Sprintf("You have %d sessions open; messages go to all of them.", n)) }
+				s.clearAutoReply(w, username)
+				s.deliverUndelivered(uc)
+				_ = s.unread(w, username, false)
+				if first { s.broadcastJoin(username, withStatus("joined", s.userStatus(username))) }
+				s.writePrompt(w, username)
+				continue
+			}
+			if strings.HasPrefix(line, "caps ") {
+				if err := setCaps(w, strings.Fields(line)[1:]); err != nil { errorLine(w, err.Error()) } else { systemLine(w, "OK") }
+				write(w, colors.system, ">> ")
+				continue
+			}
+			if _, isRegister := cutWord(line, "register"); isRegister {
+				u, p, code, ok := parseRegister(raw)
+				if !ok {
+					errorLine(w, "Usage: register <username> <password> <invite-code>")
+					write(w, colors.system, ">> ")
+					continue
+				}
+				if err := s.register(u, p, code); err != nil {
+					errorLine(w, "Registration failed: "+err.Error())
+				} else {
+					log.Printf("Registered user %s with invite\n", u)
+					systemLine(w, "Registered "+u+". You can now login.")
+				}
+				write(w, colors.system, ">> ")
 				continue
 			}
-			writeLine(w, yellow, "Please login first:  login <username> <password>")
-			write(w, yellow, ">> ")
+			systemLine(w, "Please login first:  login <username> <password>")
+			write(w, colors.system, ">> ")
 			continue
 		}
 
 		// After login
-		if line == "/quit" {
-			break
+		if exp, ok := s.expandAlias(username, line); ok { line, raw = exp, exp }
+		name, rest, _ := strings.Cut(line, " ")
+		cmd, isCmd := commands[name]
+		if name != "/quit" && name != "/afk" && name != "/pong" && s.setAFK(username, false, "") {
+			systemLine(w, "Welcome back, you are no longer AFK.")
+			s.broadcastPresence(username, "is back.")
 		}
-
-		if strings.HasPrefix(line, "/history") {
-			parts := strings.Fields(line)
-			n := 50
-			if len(parts) == 2 { if v, err := strconv.Atoi(parts[1]); err==nil && v>0 && v<=1000 { n = v } }
-			s.printHistory(w, n)
-			writePrompt(w, username)
+		if confirmDelete && name != "/quit" {
+			confirmDelete = false
+			if line == "keep" || line == "purge" {
+				if err := s.deleteAccount(username, line == "purge"); err != nil {
+					errorLine(w, "Could not delete account: "+err.Error())
+					s.writePrompt(w, username)
+					continue
+				}
+				log.Printf("Account %s deleted (%s messages)\n", username, line)
+				s.closeSessions(username, w, "Your account was deleted from another session. Goodbye.")
+				systemLine(w, "Account deleted. Goodbye.")
+				break
+			}
+			systemLine(w, "Account deletion cancelled.")
+			s.writePrompt(w, username)
 			continue
 		}
-
-		// Video commands
-		switch line {
-		case "/video":
-			s.handleVideoRequest(username)
-			writePrompt(w, username)
-			continue
-		case "/acceptvideo":
-			s.handleVideoAccept(username)
-			writePrompt(w, username)
-			continue
-		case "/declinevideo":
-			s.handleVideoDecline(username)
-			writePrompt(w, username)
+		if isCmd {
+			ctx := &cmdContext{s: s, w: w, conn: conn, username: username, raw: raw, rest: strings.TrimSpace(rest), compressed: compressed}
+			if err := cmd(ctx, strings.Fields(rest)); err != nil {
+				errorLine(w, err.Error())
+			}
+			if ctx.quit { break }
+			if ctx.swapReader != nil {
+				r = s.newScanner(ctx.swapReader, func() bool { return username != "" })
+				compressed = true
+			}
+			confirmDelete = ctx.confirmDelete
+			if ctx.loggedOut {
+				username = ""
+				idle.stop(); idle = nil
+				s.startLoginTimer(conn)
+				continue
+			}
+			s.writePrompt(w, username)
 			continue
 		}
 
 		// Regular message
-		if err := s.sendToPeer(username, line); err != nil {
-			writeLine(w, yellow, "Peer is offline (message queued).")
-		}
-		writePrompt(w, username)
+		s.relay(w, username, line, msgOpts{})
+		s.writePrompt(w, username)
+	}
+
+	if errors.Is(r.Err(), errInputTooLong) {
+		log.Printf("Input too long before login from %s; disconnecting\n", conn.RemoteAddr())
+		errorLine(w, fmt.Sprintf("Input too long (max %d bytes before login), disconnecting.", s.opts.maxLoginLine))
+	}
+	if errors.Is(r.Err(), bufio.ErrTooLong) {
+		log.Printf("Line too long from %s; disconnecting\n", conn.RemoteAddr())
+		errorLine(w, fmt.Sprintf("Line too long (max %d bytes), disconnecting.", s.opts.maxLine))
+	}
+	if ne, ok := r.Err().(net.Error); ok && ne.Timeout() {
+		if username == "" { systemLine(w, "Login timeout") } else { systemLine(w, "Disconnected for inactivity.") }
 	}
 
 	// disconnect
 	if username != "" {
-		s.detach(username)
-		s.systemBroadcast(username, fmt.Sprintf("%s left.", username))
+		s.logout(username, w)
 	}
 }
 
-func (s *chatServer) checkPassword(username, password string) bool {
-	var hash []byte
-	err := s.db.QueryRow(`SELECT password_hash FROM users WHERE username=?`, username).Scan(&hash)
-	if err != nil { return false }
-	return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
-}
+// ===== Commands =====
+// Slash-commands available after login live in commands, keyed by name. handle
+// splits the line on the first space and dispatches on the name; args are the
+// remaining words, and ctx.rest the same text untokenized for commands that take
+// free text. An error a command returns is shown to the user as a system line.
+// Lines starting with an unknown /name are sent as ordinary messages.
 
-func (s *chatServer) attach(username string, conn net.Conn, w *bufio.Writer) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	if old := s.clients[username]; old != nil { old.conn.Close() }
-	s.clients[username] = &userConn{name: username, conn: conn, w: w}
+// cmdContext is what a command sees of the connection it runs on. The fields
+// after conn let a command steer handle's loop.
+type cmdContext struct {
+	s        *chatServer
+	w        *outbox
+	conn     net.Conn
+	username string
+	raw      string // the line as received, untrimmed
+	rest     string // the line after the command name, trimmed
+
+	compressed    bool      // /compress on already happened on this connection
+	quit          bool      // disconnect now
+	loggedOut     bool      // the user logged out; back to the login prompt
+	confirmDelete bool      // the next line answers /delete-account
+	swapReader    io.Reader // read further input from here (/compress on)
 }
 
-func (s *chatServer) detach(username string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.clients, username)
-	delete(s.videoReq, username) // clear pending prompts for this user
+var commands map[string]func(ctx *cmdContext, args []string) error
+
+func init() {
+	commands = map[string]func(ctx *cmdContext, args []string) error{
+		"/help":           cmdHelp,
+		"/quit":           cmdQuit,
+		"/cls":            cmdCls,
+		"/logout":         cmdLogout,
+		"/afk":            cmdAFK,
+		"/delete-account": cmdDeleteAccount,
+		"/history":        cmdHistory,
+		"/replayall":      cmdReplayAll,
+		"/missed":         cmdMissed,
+		"/mark":           cmdMark,
+		"/unread":         cmdUnread,
+		"/me":             cmdMe,
+		"/dm":             cmdDM,
+		"/draft":          cmdDraft,
+		"/snippet":        cmdSnippet,
+		"/alias":          cmdAlias,
+		"/unalias":        cmdUnalias,
+		"/autoreply":      cmdAutoReply,
+		"/search":         cmdSearch,
+		"/context":        cmdMsgContext,
+		"/digest":         cmdDigest,
+		"/echo":           cmdEcho,
+		"/bell":           cmdBell,
+		"/joins":          cmdJoins,
+		"/width":          cmdWidth,
+		"/compress":       cmdCompress,
+		"/summary":        cmdSummary,
+		"/pin":            cmdPin,
+		"/unpin":          cmdPin,
+		"/pins":           cmdPins,
+		"/color":          cmdColor,
+		"/prompt":         cmdPrompt,
+		"/tz":             cmdTZ,
+		"/time":           cmdTime,
+		"/block":          cmdBlock,
+		"/unblock":        cmdBlock,
+		"/queued":         cmdQueued,
+		"/invite":         cmdInvite,
+		"/video":          cmdVideo,
+		"/acceptvideo":    cmdAcceptVideo,
+		"/declinevideo":   cmdDeclineVideo,
+		"/cancelvideo":    cmdCancelVideo,
+		"/novideo":        cmdNoVideo,
+		"/mysession":      cmdMySession,
+		"/endvideo":       cmdEndVideo,
+		"/status":         cmdStatus,
+		"/who":            cmdWho,
+		"/whois":          cmdWhois,
+		"/sessions":       cmdSessions,
+		"/ping-peer":      cmdPingPeer,
+		"/pong":           cmdPong,
+		"/forward":        cmdForward,
+		"/reply":          cmdReply,
+		"/resend":         cmdResend,
+		"/thread":         cmdThread,
+		"/slowmode":       cmdSlowMode,
+		"/ack-request":    cmdAckRequest,
+		"/ack":            cmdAck,
+		"/poll":           cmdPoll,
+		"/vote":           cmdVote,
+		"/logins":         cmdLogins,
+		"/backup":         cmdBackup,
+		"/export":         cmdExport,
+		"/ban-ip":         cmdBanIP,
+		"/unban-ip":       cmdUnbanIP,
+		"/drain":          cmdDrain,
+		"/set":            cmdSet,
+		"/get":            cmdGet,
+	}
 }
 
-func (s *chatServer) peerOf(u string) string {
-	if u == bilalUser { return zohaibUser }
-	return bilalUser
+// cmdDoc is a command's /help entry: usage and a one-line summary for the list,
+// and optional detail shown by /help <command>.
+type cmdDoc struct {
+	usage, summary, detail string
 }
 
-func (s *chatServer) sendToPeer(from, text string) error {
-	peer := s.peerOf(from)
+var commandDocs = map[string]cmdDoc{
+	"/help":           {"/help [command]", "list commands, or explain one", ""},
+	"/quit":           {"/quit", "disconnect", ""},
+	"/cls":            {"/cls", "clear your screen", "Only your terminal is cleared; history is untouched. Does nothing on connections with caps colors=off."},
+	"/logout":         {"/logout", "log out and return to the login prompt", ""},
+	"/afk":            {"/afk [reason]", "mark yourself away until you next type", "Your peer is told once, with the reason, the next time they message you."},
+	"/delete-account": {"/delete-account <password>", "delete your account", "You're then asked whether to keep or purge the messages you sent. The admin and the last remaining account can't be deleted."},
+	"/history":        {"/history [json] [--chat-only] [N]", "show recent messages", "Also /history edits <id>. N defaults to 50 (max 1000). json prints one JSON array of {id, sender, text, ts} for clients. --chat-only hides actions and notices. edits lists earlier versions of an edited message."},
+	"/replayall":      {"/replayall [N]", "redraw recent messages as they were delivered", "Use after your terminal was cleared. N defaults to 50."},
+	"/missed":         {"/missed", "show again the messages you missed while offline", "Repeats the block shown when you logged in this time. Nothing is marked or changed."},
+	"/mark":           {"/mark", "remember that you've read up to here", "Records the newest message you've seen as your read position. It moves forward by itself as messages reach you live; /unread and the login banner count what came after it."},
+	"/unread":         {"/unread", "count messages since your /mark", ""},
+	"/me":             {"/me <action>", "send an action, shown as \"* you <action>\"", ""},
+	"/dm":             {"/dm <text>", "send a message that is never saved", "Delivered only if your peer is online, marked (not saved), and absent from history and search."},
+	"/draft":          {"/draft save|show|send|clear", "stage one unsent message", "/draft save <text> stages it and /draft send sends it. The draft lives on this connection only and is lost when you disconnect."},
+	"/snippet":        {"/snippet save|list|send|delete", "keep named messages you send often", "/snippet save <name> <text> stores one (replacing a snippet of that name), /snippet send <name> sends it as a normal message. Names are up to 32 letters, digits, - or _. You can keep 50 snippets of up to 1000 bytes each."},
+	"/alias":          {"/alias [list|<name> <command>]", "define a shortcut for a command", "/alias h /history makes /h run /history; anything typed after /h is appended, so /alias brb /afk be right back works too. Aliases must point at a built-in command, not another alias, and can't reuse a built-in name. With no arguments or list, shows your aliases. You can keep 50."},
+	"/unalias":        {"/unalias <name>", "remove one of your aliases", ""},
+	"/autoreply":      {"/autoreply [persist] <text>|off", "reply automatically while you're offline", "Cleared at your next login unless set with persist."},
+	"/search":         {"/search [from:u] [to:u] <text>", "search messages", "from:<user> and to:<user> narrow by sender and recipient. Matches text anywhere in a message, case-insensitively; shows up to 50 newest matches."},
+	"/context":        {"/context <message id> [N]", "show the messages around one message", "N messages either side (default 5, max 50), oldest first, with the given message highlighted. Use with the ids /search prints."},
+	"/digest":         {"/digest [YYYY-MM-DD]", "recap one day of messages", "Defaults to today. Shows messages per user with their first and last times, then the first and last few messages of the day. Days are UTC days."},
+	"/echo":           {"/echo on|off", "show your own messages back to you", ""},
+	"/bell":           {"/bell on|off", "ring the terminal bell when a message arrives", "Never for your own messages. Same as /set bell."},
+	"/joins":          {"/joins on|off", "show when others join or leave", "On by default. AFK and status changes are still shown. Same as /set joins."},
+	"/width":          {"/width <columns>|off", "wrap messages to your terminal width", "Columns from 40 to 1000. Wrapping breaks between words and indents continuation lines under the text."},
+	"/compress":       {"/compress on", "compress this connection with DEFLATE", "Your client must switch to raw DEFLATE in both directions right after the \"Compression on.\" reply, and send nothing in between. It stays on until you disconnect."},
+	"/summary":        {"/summary [N]", "summarize the last N messages with an LLM", "N defaults to 50 (max 500). Unavailable when the server runs with -no-summary."},
+	"/pin":            {"/pin <id>", "pin a message", ""},
+	"/unpin":          {"/unpin <id>", "unpin a message", ""},
+	"/pins":           {"/pins", "list pinned messages", ""},
+	"/color":          {"/color <name|reset>", "choose the color your messages show in", ""},
+	"/prompt":         {"/prompt <format|reset>", "customize your prompt", "Tokens: %u you, %p your peer, %t the time (HH:MM), %% a literal %. Trailing spaces count."},
+	"/tz":             {"/tz <zone|reset>", "show timestamps in your timezone", "Zone is an IANA name such as Europe/London, or UTC."},
+	"/time":           {"/time", "show the server clock and timezone", "The time is UTC in RFC 3339 form, so a client can work out its offset from the server. It is also sent once at login."},
+	"/block":          {"/block <user>", "refuse all messages from a user", ""},
+	"/unblock":        {"/unblock <user>", "accept messages from a user again", ""},
+	"/queued":         {"/queued [user]", "count messages waiting for your peer", "The admin can ask about any user."},
+	"/invite":         {"/invite [hours]", "create a registration invite (admin)", "The code is single-use and expires after hours (default 24)."},
+	"/video":          {"/video [call]", "ask your peer to share their camera", "/video call asks for a two-way call instead, where both of you share camera and microphone."},
+	"/acceptvideo":    {"/acceptvideo", "accept a video request", ""},
+	"/declinevideo":   {"/declinevideo", "decline a video request", ""},
+	"/cancelvideo":    {"/cancelvideo", "withdraw your video request before it's answered", ""},
+	"/novideo":        {"/novideo on|off", "refuse video requests without being asked", ""},
+	"/mysession":      {"/mysession", "show the URL of your current video session again", "For when you closed the browser tab. Only sessions that haven't ended are shown."},
+	"/endvideo":       {"/endvideo", "end your active video sessions", "Closes the session in both browsers. When the server limits video sessions per user (-max-video-sessions), this frees your slot at once; sessions whose tabs are all closed are also noticed when you next ask."},
+	"/status":         {"/status [text|clear]", "set a status line your peer sees", "Shown in /who and when you join, e.g. \"zohaib joined — 🍜 at lunch\". Up to 80 characters; it stays until you clear it."},
+	"/who":            {"/who", "show who's online, with their status", ""},
+	"/resend":         {"/resend", "retry delivering your last queued message", "Sends your newest message that your peer hasn't received yet to their open sessions now, instead of waiting for their next login."},
+	"/thread":         {"/thread new|post|list|view|close", "keep parallel topics apart", "/thread new <topic> starts one and /thread post <id> <text> sends a message into it, labeled with the topic. /thread list shows open threads, /thread view <id> a thread's messages, and /thread close <id> stops further posts."},
+	"/slowmode":       {"/slowmode [seconds|off]", "show slow mode, or pace everyone's messages (admin)", "With slow mode on, each user must wait that many seconds between messages, including /dm, /snippet send, /poll and /vote. The setting is saved and survives restarts."},
+	"/reply":          {"/reply <id> <text>", "answer a message, quoting it", "Your message is shown with a one-line excerpt of message <id> above it, live, offline and in history."},
+	"/whois":          {"/whois <user>", "show a user's profile", "Role, presence and status, when they were last on, their color and how many messages they've sent. The admin also sees their first and last login addresses."},
+	"/sessions":       {"/sessions [kill <id>]", "list your open sessions, or close one", "Shows each connection you're logged in on with its address and login time. kill <id> disconnects that one, e.g. a session you left open elsewhere."},
+	"/ping-peer":      {"/ping-peer", "measure the round trip to your peer", "Needs a client that answers: sessions with tags on get \"!PING! <id>\" and should reply /pong <id>. Otherwise it only reports whether your peer is connected, and for how long."},
+	"/pong":           {"/pong <id>", "answer a /ping-peer (sent by clients, not typed)", ""},
+	"/forward":        {"/forward <id> <user>", "send a message from your conversation on, credited to its sender", "The copy reads \"(forwarded from <sender>) ...\" and keeps a link to the original. With only two users, the target is always your peer."},
+	"/ack-request":    {"/ack-request <text>", "send a message your peer must acknowledge", "It shows as awaiting acknowledgment in /history until they /ack it, and both of you are reminded while it's outstanding (see -ack-remind and /set acks off)."},
+	"/ack":            {"/ack <id>", "acknowledge a message sent with /ack-request", "The sender is told right away if they're online."},
+	"/poll":           {"/poll [<question>|close [id]]", "ask your peer a yes/no question", "The question is sent as a message and your peer answers with /vote. /poll alone lists open polls with their tallies; /poll close ends your newest open poll (or poll id) and tells you both the result."},
+	"/vote":           {"/vote yes|no [poll id]", "answer a /poll", "Without an id, answers the newest open poll your peer asked. You can change your vote until the poll is closed."},
+	"/logins":         {"/logins [N]", "list recent login attempts (admin)", "Shows the last N attempts (default 20, max 500), successful or not, with the address they came from."},
+	"/drain":          {"/drain", "announce a restart, disconnect everyone and exit (admin)", "New connections and messages are refused, everyone is told to reconnect in a moment, queued output is flushed, and the process exits once all sessions have closed (at most 10s). SIGUSR1 does the same."},
+	"/ban-ip":         {"/ban-ip [<addr>|<cidr>]", "refuse connections from an address or range (admin)", "With no argument, lists the bans. Banned connections are closed as soon as they're accepted, before the welcome; connections already open from there, logged in or not, are closed too. Bans persist across restarts."},
+	"/unban-ip":       {"/unban-ip <addr>|<cidr>", "lift an IP ban (admin)", "Give the address or range as /ban-ip lists it."},
+	"/backup":         {"/backup <file>", "snapshot the database while the server runs (admin)", "Writes a consistent copy with VACUUM INTO. <file> is relative to the -backup-dir directory, may not contain .., and must not already exist."},
+	"/export":         {"/export <file>", "save the whole conversation to a file on the server (admin)", "Writes every chat message and /me action, oldest first, to <file> under the -export-dir directory. <file> may not contain .. and must not already exist. When the server runs with -export-key the transcript is encrypted to that PGP public key and written ASCII-armored, with .asc appended if missing; otherwise it is plain text."},
+	"/set":            {"/set [<key> <value>|<key> reset]", "change a saved preference", "With no arguments, lists every preference and its value. Keys: echo (on|off), width (40-1000|off), tz (an IANA zone), acks (on|off, reminders about /ack-request messages), tags (on|off, start system lines with !SYS! and errors with !ERR! for clients), bell (on|off). Preferences persist across logins."},
+	"/get":            {"/get <key>", "show a saved preference", ""},
+}
 
-	// persist first
-	res, err := s.db.Exec(`INSERT INTO messages(sender, recipient, text, delivered) VALUES(?,?,?,0)`, from, peer, text)
-	if err != nil { return fmt.Errorf("db: %w", err) }
-	id, _ := res.LastInsertId()
+// commandName is the name a command was invoked as ("/pin" or "/unpin").
+func (ctx *cmdContext) commandName() string {
+	name, _, _ := strings.Cut(strings.TrimSpace(ctx.raw), " ")
+	return name
+}
 
-	// try deliver if online
-	s.mu.Lock(); dst := s.clients[peer]; s.mu.Unlock()
-	if dst == nil { return errors.New("peer offline") }
+// cmdHelp lists every registered command, so the list can't drift from what
+// handle actually dispatches; /help <command> adds the detail.
+func cmdHelp(ctx *cmdContext, args []string) error {
+	if len(args) == 1 {
+		name := "/" + strings.TrimPrefix(args[0], "/")
+		if _, ok := commands[name]; !ok { return errors.New("No such command: " + name + ". Type /help for the list.") }
+		d := commandDocs[name]
+		systemLine(ctx.w, "Usage: "+d.usage)
+		systemLine(ctx.w, "  "+d.summary)
+		if d.detail != "" { systemLine(ctx.w, "  "+d.detail) }
+		return nil
+	}
+	names := make([]string, 0, len(commands))
+	for n := range commands { names = append(names, n) }
+	sort.Strings(names)
+	lines := make([]string, 0, len(names)+1)
+	lines = append(lines, "Commands (/help <command> for details):")
+	for _, n := range names {
+		d := commandDocs[n]
+		if d.usage == "" { d.usage = n }
+		lines = append(lines, fmt.Sprintf("  %-34s %s", d.usage, d.summary))
+	}
+	for _, l := range lines { systemLine(ctx.w, l) }
+	return nil
+}
 
-	ts := time.Now().Format("15:04:05")
-	color := green
-	if from == zohaibUser { color = cyan }
-	writeLine(dst.w, color, fmt.Sprintf("[%s] %s: %s", ts, from, text))
-	_, _ = s.db.Exec(`UPDATE messages SET delivered=1 WHERE id=?`, id)
+func cmdQuit(ctx *cmdContext, args []string) error {
+	ctx.quit = true
 	return nil
 }
 
-func (s *chatServer) deliverUndelivered(toUser string) {
-	rows, err := s.db.Query(`
-SELECT id, sender, text, strftime('%H:%M:%S', ts)
-FROM messages WHERE recipient=? AND delivered=0 ORDER BY ts ASC`, toUser)
-	if err != nil { return }
-	defer rows.Close()
+// cmdCls clears the caller's screen; the command loop redraws the prompt at the
+// top afterwards.
+func cmdCls(ctx *cmdContext, args []string) error {
+	if ctx.w.plain.Load() { systemLine(ctx.w, "Screen clearing needs ANSI; this connection has colors off."); return nil }
+	ctx.w.send(clearScreen)
+	return nil
+}
 
-	s.mu.Lock(); uc := s.clients[toUser]; s.mu.Unlock()
-	if uc == nil { return }
+func cmdLogout(ctx *cmdContext, args []string) error {
+	ctx.s.logout(ctx.username, ctx.w)
+	ctx.loggedOut = true
+	systemLine(ctx.w, "Logged out. Login with:  login <username> <password>")
+	write(ctx.w, colors.system, ">> ")
+	return nil
+}
 
-	count := 0
-	var ids []int64
-	for rows.Next() {
-		var id int64; var sender, text, hhmmss string
-		_ = rows.Scan(&id, &sender, &text, &hhmmss)
-		c := green; if sender == zohaibUser { c = cyan }
-		writeLine(uc.w, c, fmt.Sprintf("[missed %s] %s: %s", hhmmss, sender, text))
-		ids = append(ids, id); count++
-	}
-	if count > 0 {
-		writeLine(uc.w, yellow, fmt.Sprintf("You had %d offline message(s).", count))
-		// mark delivered
-		if len(ids) > 0 {
-			placeholders := strings.TrimRight(strings.Repeat("?,", len(ids)), ",")
-			args := make([]any, len(ids))
-			for i, id := range ids { args[i] = id }
-			_, _ = s.db.Exec(`UPDATE messages SET delivered=1 WHERE id IN (`+placeholders+`)`, args...)
-		}
-	}
+func cmdAFK(ctx *cmdContext, args []string) error {
+	ctx.s.setAFK(ctx.username, true, ctx.rest)
+	systemLine(ctx.w, "You are now AFK. Type anything to come back.")
+	ctx.s.broadcastPresence(ctx.username, withStatus("is now AFK", ctx.rest))
+	return nil
 }
 
-func (s *chatServer) printHistory(w *bufio.Writer, n int) {
-	rows, _ := s.db.Query(`
-SELECT sender, recipient, text, strftime('%H:%M:%S', ts)
-FROM messages
-WHERE sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')
-ORDER BY ts DESC LIMIT ?`, n)
-	defer rows.Close()
-	var stack [][4]string
-	for rows.Next() {
-		var sdr, rcp, txt, hh string
-		_ = rows.Scan(&sdr, &rcp, &txt, &hh)
-		stack = append(stack, [4]string{sdr, rcp, txt, hh})
+func cmdDeleteAccount(ctx *cmdContext, args []string) error {
+	s := ctx.s
+	switch {
+	case len(args) == 0:
+		return errors.New("Usage: /delete-account <password>")
+	case ctx.username == s.opts.admin:
+		return errors.New("The admin account cannot be deleted.")
+	case s.userCount() <= 1:
+		return errors.New("The last remaining account cannot be deleted.")
 	}
-	for i := len(stack)-1; i>=0; i-- {
-		sdr, _, txt, hh := stack[i][0], stack[i][1], stack[i][2], stack[i][3]
-		c := green; if sdr==zohaibUser { c = cyan }
-		writeLine(w, c, fmt.Sprintf("[%s] %s: %s", hh, sdr, txt))
+	switch err := s.checkPassword(ctx.username, strings.TrimPrefix(strings.TrimLeft(ctx.raw, " \t"), "/delete-account ")); err {
+	case nil:
+	case errServerBusy: return errors.New("Server busy, retry.")
+	default: return errors.New("Invalid password.")
 	}
+	ctx.confirmDelete = true
+	systemLine(ctx.w, "Also delete the messages you sent? Reply keep, purge, or anything else to cancel.")
+	return nil
+}
+
+func cmdHistory(ctx *cmdContext, args []string) error {
+	if len(args) >= 1 && args[0] == "edits" {
+		ctx.s.printEdits(ctx.w, ctx.username, args[1:])
+		return nil
+	}
+	n, chatOnly, asJSON := 50, false, false
+	for _, a := range args {
+		if a == "--chat-only" { chatOnly = true; continue }
+		if a == "json" { asJSON = true; continue }
+		if v, err := strconv.Atoi(a); err==nil && v>0 && v<=1000 { n = v }
+	}
+	if asJSON { ctx.s.printHistoryJSON(ctx.w, n, chatOnly) } else { ctx.s.printHistory(ctx.w, ctx.username, n, chatOnly) }
+	return nil
+}
+
+func cmdReplayAll(ctx *cmdContext, args []string) error {
+	n := 50
+	if len(args) == 1 {
+		if v, err := strconv.Atoi(args[0]); err == nil && v > 0 && v <= 1000 { n = v }
+	}
+	ctx.s.replayAll(ctx.w, ctx.username, n)
+	return nil
+}
+
+// cmdMe is an emote: /me waves -> "* bilal waves"
+func cmdMe(ctx *cmdContext, args []string) error {
+	if ctx.rest == "" { return errors.New("Usage: /me <action>") }
+	ctx.s.relay(ctx.w, ctx.username, ctx.rest, msgOpts{action: true})
+	return nil
+}
+
+func cmdDM(ctx *cmdContext, args []string) error {
+	if ctx.rest == "" { return errors.New("Usage: /dm <text>  (delivered only if your peer is online; never saved)") }
+	ctx.s.sendEphemeral(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdDraft(ctx *cmdContext, args []string) error {
+	ctx.s.handleDraft(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdSnippet(ctx *cmdContext, args []string) error {
+	return ctx.s.handleSnippet(ctx.w, ctx.username, args, ctx.rest)
+}
+
+func cmdAlias(ctx *cmdContext, args []string) error {
+	return ctx.s.handleAlias(ctx.w, ctx.username, args, ctx.rest)
+}
+
+func cmdUnalias(ctx *cmdContext, args []string) error {
+	if len(args) != 1 { return errors.New("Usage: /unalias <name>") }
+	name := strings.TrimPrefix(args[0], "/")
+	res, err := ctx.s.execRetry(`DELETE FROM aliases WHERE user=? AND name=?`, ctx.username, name)
+	if err != nil { return errors.New("Could not remove the alias.") }
+	if n, _ := res.RowsAffected(); n == 0 { return errors.New("No alias named /" + name + ".") }
+	systemLine(ctx.w, "Alias /"+name+" removed.")
+	return nil
+}
+
+func cmdAutoReply(ctx *cmdContext, args []string) error {
+	ctx.s.handleAutoReply(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdSearch(ctx *cmdContext, args []string) error {
+	ctx.s.handleSearch(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdEcho(ctx *cmdContext, args []string) error {
+	if ctx.rest != "on" && ctx.rest != "off" { return errors.New("Usage: /echo on|off") }
+	if err := ctx.s.setPref(ctx.username, "echo", ctx.rest); err != nil { return err }
+	if ctx.rest == "on" {
+		systemLine(ctx.w, "Echo on: your messages will be shown back to you.")
+	} else {
+		systemLine(ctx.w, "Echo off.")
+	}
+	return nil
+}
+
+func cmdJoins(ctx *cmdContext, args []string) error {
+	if ctx.rest != "on" && ctx.rest != "off" { return errors.New("Usage: /joins on|off") }
+	if err := ctx.s.setPref(ctx.username, "joins", ctx.rest); err != nil { return err }
+	systemLine(ctx.w, "Join and leave notices "+ctx.rest+".")
+	return nil
+}
+
+func cmdBell(ctx *cmdContext, args []string) error {
+	if ctx.rest != "on" && ctx.rest != "off" { return errors.New("Usage: /bell on|off") }
+	if err := ctx.s.setPref(ctx.username, "bell", ctx.rest); err != nil { return err }
+	systemLine(ctx.w, "Bell "+ctx.rest+".")
+	return nil
+}
+
+func cmdWidth(ctx *cmdContext, args []string) error {
+	v, err := prefDefs["width"].parse(ctx.rest)
+	if err != nil { return errors.New("Usage: /width <columns 40-1000>|off  (wraps messages to your terminal width)") }
+	if err := ctx.s.setPref(ctx.username, "width", v); err != nil { return err }
+	if v == "off" {
+		systemLine(ctx.w, "Wrapping off.")
+	} else {
+		systemLine(ctx.w, "Wrapping messages at "+v+" columns.")
+	}
+	return nil
+}
+
+func cmdStatus(ctx *cmdContext, args []string) error {
+	ctx.s.handleStatus(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdWho(ctx *cmdContext, args []string) error {
+	ctx.s.printWho(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdWhois(ctx *cmdContext, args []string) error {
+	if len(args) != 1 { return errors.New("Usage: /whois <user>") }
+	return ctx.s.whois(ctx.w, ctx.username, args[0])
+}
+
+func cmdSessions(ctx *cmdContext, args []string) error {
+	switch {
+	case len(args) == 0:
+		ctx.s.listSessions(ctx.w, ctx.username)
+		return nil
+	case len(args) == 2 && args[0] == "kill":
+		id, err := strconv.ParseInt(strings.TrimPrefix(args[1], "#"), 10, 64)
+		if err != nil { return errors.New("Usage: /sessions kill <id>") }
+		return ctx.s.killSession(ctx.w, ctx.username, id)
+	}
+	return errors.New("Usage: /sessions [kill <id>]")
+}
+
+func cmdPingPeer(ctx *cmdContext, args []string) error {
+	return ctx.s.pingPeer(ctx.w, ctx.username)
+}
+
+func cmdPong(ctx *cmdContext, args []string) error {
+	if len(args) != 1 { return errors.New("Usage: /pong <id>") }
+	ctx.s.pong(ctx.username, args[0])
+	return nil
+}
+
+func cmdSlowMode(ctx *cmdContext, args []string) error {
+	ctx.s.handleSlowMode(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdForward(ctx *cmdContext, args []string) error {
+	if len(args) != 2 { return errors.New("Usage: /forward <message id> <user>") }
+	id, ok := parseMessageID(args[:1])
+	if !ok { return errors.New("Usage: /forward <message id> <user>") }
+	ctx.s.forward(ctx.w, ctx.username, id, args[1])
+	return nil
+}
+
+func cmdMsgContext(ctx *cmdContext, args []string) error {
+	const usage = "Usage: /context <message id> [N]"
+	if len(args) < 1 || len(args) > 2 { return errors.New(usage) }
+	id, ok := parseMessageID(args[:1])
+	if !ok { return errors.New(usage) }
+	n := defaultContext
+	if len(args) == 2 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 || v > maxContext { return fmt.Errorf("N must be 0 to %d.", maxContext) }
+		n = v
+	}
+	rows, found := ctx.s.contextRows(id, n)
+	if !found { return fmt.Errorf("No message #%d.", id) }
+	ctx.s.printRows(ctx.w, ctx.username, rows, id)
+	return nil
+}
+
+func cmdDigest(ctx *cmdContext, args []string) error {
+	day := time.Now().UTC().Format("2006-01-02")
+	if len(args) > 1 { return errors.New("Usage: /digest [YYYY-MM-DD]") }
+	if len(args) == 1 {
+		if _, err := time.Parse("2006-01-02", args[0]); err != nil { return errors.New("Usage: /digest [YYYY-MM-DD]") }
+		day = args[0]
+	}
+	return ctx.s.digest(ctx.w, ctx.username, day)
+}
+
+func cmdReply(ctx *cmdContext, args []string) error {
+	const usage = "Usage: /reply <message id> <text>"
+	if len(args) < 2 { return errors.New(usage) }
+	id, ok := parseMessageID(args[:1])
+	if !ok { return errors.New(usage) }
+	_, text, _ := strings.Cut(ctx.rest, " ")
+	ctx.s.reply(ctx.w, ctx.username, id, strings.TrimSpace(text))
+	return nil
+}
+
+func cmdResend(ctx *cmdContext, args []string) error {
+	return ctx.s.resend(ctx.w, ctx.username)
+}
+
+func cmdThread(ctx *cmdContext, args []string) error {
+	const usage = "Usage: /thread new <topic> | /thread post <id> <text> | /thread list | /thread view <id> | /thread close <id>"
+	if len(args) == 0 { return errors.New(usage) }
+	_, rest, _ := strings.Cut(ctx.rest, " ")
+	rest = strings.TrimSpace(rest)
+	switch args[0] {
+	case "new":
+		return ctx.s.newThread(ctx.w, ctx.username, rest)
+	case "list":
+		ctx.s.listThreads(ctx.w, ctx.username)
+		return nil
+	case "post":
+		if len(args) < 3 { return errors.New("Usage: /thread post <id> <text>") }
+		id, ok := parseMessageID(args[1:2])
+		if !ok { return errors.New("Usage: /thread post <id> <text>") }
+		_, text, _ := strings.Cut(rest, " ")
+		return ctx.s.postThread(ctx.w, ctx.username, id, strings.TrimSpace(text))
+	case "view", "close":
+		id, ok := parseMessageID(args[1:])
+		if !ok { return errors.New("Usage: /thread " + args[0] + " <id>") }
+		if args[0] == "close" { return ctx.s.closeThread(ctx.w, ctx.username, id) }
+		return ctx.s.viewThread(ctx.w, ctx.username, id)
+	}
+	return errors.New(usage)
+}
+
+func cmdAckRequest(ctx *cmdContext, args []string) error {
+	if ctx.rest == "" { return errors.New("Usage: /ack-request <text>") }
+	ctx.s.relay(ctx.w, ctx.username, ctx.rest, msgOpts{ack: true})
+	return nil
+}
+
+func cmdAck(ctx *cmdContext, args []string) error {
+	id, ok := parseMessageID(args)
+	if !ok { return errors.New("Usage: /ack <message id>") }
+	ctx.s.ack(ctx.w, ctx.username, id)
+	return nil
+}
+
+func cmdPoll(ctx *cmdContext, args []string) error {
+	switch {
+	case len(args) == 0:
+		ctx.s.listPolls(ctx.w, ctx.username)
+		return nil
+	case args[0] == "close" && len(args) <= 2:
+		var id int64
+		if len(args) == 2 {
+			var ok bool
+			if id, ok = parseMessageID(args[1:]); !ok { return errors.New("Usage: /poll close [poll id]") }
+		}
+		return ctx.s.closePoll(ctx.w, ctx.username, id)
+	}
+	return ctx.s.startPoll(ctx.w, ctx.username, ctx.rest)
+}
+
+func cmdVote(ctx *cmdContext, args []string) error {
+	const usage = "Usage: /vote yes|no [poll id]"
+	if len(args) < 1 || len(args) > 2 || (args[0] != "yes" && args[0] != "no") { return errors.New(usage) }
+	var id int64
+	if len(args) == 2 {
+		var ok bool
+		if id, ok = parseMessageID(args[1:]); !ok { return errors.New(usage) }
+	}
+	return ctx.s.vote(ctx.w, ctx.username, id, args[0])
+}
+
+func cmdLogins(ctx *cmdContext, args []string) error {
+	ctx.s.handleLogins(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdMark(ctx *cmdContext, args []string) error {
+	return ctx.s.setMark(ctx.w, ctx.username)
+}
+
+func cmdUnread(ctx *cmdContext, args []string) error {
+	return ctx.s.unread(ctx.w, ctx.username, true)
+}
+
+func cmdMissed(ctx *cmdContext, args []string) error {
+	ctx.s.replayMissed(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdTime(ctx *cmdContext, args []string) error {
+	systemLine(ctx.w, ctx.s.timeLine(ctx.username, time.Now()))
+	return nil
+}
+
+func cmdBackup(ctx *cmdContext, args []string) error {
+	ctx.s.handleBackup(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdExport(ctx *cmdContext, args []string) error {
+	ctx.s.handleExport(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdDrain(ctx *cmdContext, args []string) error {
+	if ctx.username != ctx.s.opts.admin { return errors.New("Only the admin can drain the server.") }
+	if !ctx.s.drain("/drain by " + ctx.username) { return errors.New("Already draining.") }
+	return nil
+}
+
+func cmdBanIP(ctx *cmdContext, args []string) error {
+	return ctx.s.handleBanIP(ctx.w, ctx.username, args, true)
+}
+
+func cmdUnbanIP(ctx *cmdContext, args []string) error {
+	return ctx.s.handleBanIP(ctx.w, ctx.username, args, false)
+}
+
+func cmdSet(ctx *cmdContext, args []string) error {
+	ctx.s.handleSet(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdGet(ctx *cmdContext, args []string) error {
+	if len(args) != 1 { return errors.New("Usage: /get <key>") }
+	if _, ok := prefDefs[args[0]]; !ok { return errors.New("Unknown preference " + args[0] + ". Type /set for the list.") }
+	systemLine(ctx.w, prefLine(args[0], ctx.s.pref(ctx.username, args[0])))
+	return nil
+}
+
+func cmdCompress(ctx *cmdContext, args []string) error {
+	if _, ok := ctx.conn.(*wsConn); ok { return errors.New("/compress isn't available over WebSocket.") }
+	switch {
+	case ctx.rest == "on" && ctx.compressed:
+		systemLine(ctx.w, "Compression is already on.")
+	case ctx.rest == "on":
+		// The ack is the last uncompressed line. The client must send nothing
+		// after "/compress on" until it reads it, so the scanner holds no bytes
+		// past this line and can be swapped for one reading the DEFLATE stream.
+		systemLine(ctx.w, "Compression on.")
+		ctx.w.startCompression()
+		ctx.swapReader = flate.NewReader(ctx.conn)
+	case ctx.rest == "off":
+		systemLine(ctx.w, "Compression stays on until you disconnect.")
+	default:
+		return errors.New("Usage: /compress on  (your client must switch to DEFLATE after the ack)")
+	}
+	return nil
+}
+
+func cmdSummary(ctx *cmdContext, args []string) error {
+	n := 50
+	if len(args) == 1 {
+		if v, err := strconv.Atoi(args[0]); err==nil && v>0 && v<=500 { n = v }
+	}
+	ctx.s.handleSummary(ctx.w, n)
+	return nil
+}
+
+// cmdPin is /pin and /unpin.
+func cmdPin(ctx *cmdContext, args []string) error {
+	name := ctx.commandName()
+	id, ok := parseMessageID(args)
+	if !ok { return errors.New("Usage: " + name + " <message_id>") }
+	ctx.s.setPinned(ctx.w, id, name == "/pin")
+	return nil
+}
+
+func cmdPins(ctx *cmdContext, args []string) error {
+	ctx.s.printPins(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdColor(ctx *cmdContext, args []string) error {
+	ctx.s.handleColor(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdPrompt(ctx *cmdContext, args []string) error {
+	// from raw, not rest: trailing spaces are part of the format
+	format := strings.TrimRight(strings.TrimLeft(ctx.raw, " \t"), "\r\n")
+	ctx.s.handlePrompt(ctx.w, ctx.username, strings.TrimPrefix(strings.TrimPrefix(format, "/prompt"), " "))
+	return nil
+}
+
+func cmdTZ(ctx *cmdContext, args []string) error {
+	ctx.s.handleTZ(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+// cmdBlock is /block and /unblock.
+func cmdBlock(ctx *cmdContext, args []string) error {
+	ctx.s.handleBlock(ctx.w, ctx.username, ctx.rest, ctx.commandName() == "/block")
+	return nil
+}
+
+func cmdQueued(ctx *cmdContext, args []string) error {
+	ctx.s.handleQueued(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdInvite(ctx *cmdContext, args []string) error {
+	ctx.s.handleInvite(ctx.w, ctx.username, args)
+	return nil
+}
+
+func cmdVideo(ctx *cmdContext, args []string) error {
+	if ctx.rest != "" && ctx.rest != "call" { return errors.New("Usage: /video [call]") }
+	ctx.s.handleVideoRequest(ctx.w, ctx.username, ctx.rest == "call")
+	return nil
+}
+
+func cmdAcceptVideo(ctx *cmdContext, args []string) error {
+	ctx.s.handleVideoAccept(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdDeclineVideo(ctx *cmdContext, args []string) error {
+	ctx.s.handleVideoDecline(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdCancelVideo(ctx *cmdContext, args []string) error {
+	ctx.s.handleVideoCancel(ctx.w, ctx.username)
+	return nil
+}
+
+func cmdEndVideo(ctx *cmdContext, args []string) error {
+	return ctx.s.handleEndVideo(ctx.w, ctx.username)
+}
+
+func cmdNoVideo(ctx *cmdContext, args []string) error {
+	ctx.s.handleNoVideo(ctx.w, ctx.username, ctx.rest)
+	return nil
+}
+
+func cmdMySession(ctx *cmdContext, args []string) error {
+	ctx.s.handleMySession(ctx.w, ctx.username)
+	return nil
+}
+
+// logout detaches the user and tells the others; the connection itself is left
+// to the caller, so /logout can return to the login prompt on the same socket.
+func (s *chatServer) logout(username string, w *outbox) {
+	if s.detach(username, w) { s.broadcastJoin(username, "left.") }
+}
+
+// Telnet option negotiation: "server will echo" makes telnet clients stop their
+// local echo while the password is typed; "won't echo" hands it back.
+const (
+	telnetEchoOff = "\xff\xfb\x01" // IAC WILL ECHO
+	telnetEchoOn  = "\xff\xfc\x01" // IAC WONT ECHO
+)
+
+// stripTelnet removes telnet IAC sequences (e.g. the client's DO/DONT ECHO reply)
+// from an input line. 0xFF never occurs in UTF-8 text, so plain input is untouched.
+func stripTelnet(line string) string {
+	if !strings.Contains(line, "\xff") { return line }
+	var b strings.Builder
+	for i := 0; i < len(line); i++ {
+		if line[i] != 0xff { b.WriteByte(line[i]); continue }
+		if i+1 >= len(line) { break }
+		switch line[i+1] {
+		case 0xfb, 0xfc, 0xfd, 0xfe: // WILL, WONT, DO, DONT <option>
+			i += 2
+		case 0xff: // escaped 0xFF data byte
+			b.WriteByte(0xff); i++
+		default:
+			i++
+		}
+	}
+	return b.String()
+}
+
+// allowedUser reports whether u is one of the two chat participants.
+func allowedUser(u string) bool { return u == bilalUser || u == zohaibUser }
+
+// defaultReserved names would pass for the server itself or a future broadcast
+// target, so nobody may register them.
+const defaultReserved = "admin,system,server,bot,all,everyone"
+
+var errReservedName = errors.New("that name is reserved")
+
+func parseReserved(list string) map[string]bool {
+	names := map[string]bool{}
+	for _, n := range strings.Split(list, ",") {
+		if n = strings.ToLower(strings.TrimSpace(n)); n != "" { names[n] = true }
+	}
+	return names
+}
+
+// isReserved reports whether u is on -reserved-names, ignoring case.
+func (s *chatServer) isReserved(u string) bool { return s.opts.reserved[strings.ToLower(u)] }
+
+// parseLogin splits "login <username> <password>". The keyword and username
+// each end at the first run of spaces or tabs; everything after that is the
+// literal password, so its internal and trailing whitespace is preserved.
+func parseLogin(raw string) (user, pass string, ok bool) {
+	rest, found := cutWord(raw, "login")
+	if !found { return "", "", false }
+	user, pass, found = splitWord(rest)
+	if !found || pass == "" { return "", "", false }
+	return user, pass, true
+}
+
+// cutWord strips leading whitespace and then word, which must be followed by
+// whitespace, and returns what comes after that whitespace.
+func cutWord(raw, word string) (string, bool) {
+	rest, found := strings.CutPrefix(strings.TrimLeft(raw, " \t"), word)
+	if !found || rest == "" || !strings.ContainsRune(" \t", rune(rest[0])) { return "", false }
+	return strings.TrimLeft(rest, " \t"), true
+}
+
+// splitWord splits s at its first run of spaces or tabs into a non-empty first
+// word and the rest, untouched.
+func splitWord(s string) (word, rest string, ok bool) {
+	i := strings.IndexAny(s, " \t")
+	if i <= 0 { return "", "", false }
+	return s[:i], strings.TrimLeft(s[i:], " \t"), true
+}
+
+// parseRegister splits "register <username> <password> <invite-code>" like
+// parseLogin: the code is the last token and the password is everything
+// between the username and the space before it, kept literally.
+func parseRegister(raw string) (user, pass, code string, ok bool) {
+	rest, found := cutWord(raw, "register")
+	if !found { return "", "", "", false }
+	user, rest, found = splitWord(rest)
+	if !found { return "", "", "", false }
+	rest = strings.TrimRight(rest, " \t\r")
+	i := strings.LastIndexAny(rest, " \t")
+	if i < 0 { return "", "", "", false }
+	pass, code = rest[:i], rest[i+1:]
+	if pass == "" || code == "" { return "", "", "", false }
+	return user, pass, code, true
+}
+
+// checkPassword returns nil if password is username's, errBadPassword if it
+// isn't (or there's no such user), or errServerBusy.
+func (s *chatServer) checkPassword(username, password string) error {
+	var hash []byte
+	err := s.db.QueryRow(`SELECT password_hash FROM users WHERE username=?`, username).Scan(&hash)
+	if err != nil { return errBadPassword }
+	if err := s.hashing(func() { err = bcrypt.CompareHashAndPassword(hash, []byte(password)) }); err != nil { return err }
+	if err != nil { return errBadPassword }
+	return nil
+}
+
+// hashWait is how long a bcrypt operation queues for a slot before giving up.
+const hashWait = 3 * time.Second
+
+// hashing runs f, which should be a bcrypt call, once one of the -max-bcrypt
+// slots is free. bcrypt is deliberately CPU-heavy, so a login storm would
+// otherwise hash on every core at once and starve everything else; past
+// hashWait it returns errServerBusy without running f.
+func (s *chatServer) hashing(f func()) error {
+	t := time.NewTimer(hashWait)
+	defer t.Stop()
+	select {
+	case s.hashSlots <- struct{}{}:
+	case <-t.C: return errServerBusy
+	}
+	defer func() { <-s.hashSlots }()
+	f()
+	return nil
+}
+
+// ===== Invites =====
+// /invite (admin) mints a single-use code; "register <user> <password> <code>"
+// consumes it. Only the chat's fixed usernames can be registered, so in practice
+// invites restore an account that was removed with /delete-account.
+
+const defaultInviteTTL = 24 * time.Hour
+
+func (s *chatServer) handleInvite(w *outbox, username string, args []string) {
+	if username != s.opts.admin {
+		errorLine(w, "Only the admin can create invites.")
+		return
+	}
+	ttl := defaultInviteTTL
+	if len(args) == 1 {
+		h, err := strconv.Atoi(args[0])
+		if err != nil || h <= 0 || h > 24*30 {
+			errorLine(w, "Usage: /invite [hours]  (1-720)")
+			return
+		}
+		ttl = time.Duration(h) * time.Hour
+	}
+	code, err := s.createInvite(username, ttl)
+	if err != nil {
+		errorLine(w, "Could not create invite.")
+		return
+	}
+	systemLine(w, fmt.Sprintf("Invite code (valid %s, single use): %s", ttl, code))
+}
+
+func (s *chatServer) createInvite(by string, ttl time.Duration) (string, error) {
+	b := make([]byte, 8)
+	if _, err := crand.Read(b); err != nil { return "", err }
+	code := hex.EncodeToString(b)
+	_, err := s.db.Exec(`INSERT INTO invites(code, created_by, expires_at) VALUES(?,?,?)`,
+		code, by, time.Now().UTC().Add(ttl).Format("2006-01-02 15:04:05"))
+	return code, err
+}
+
+// register creates an account. The invite code is consumed before the password
+// is hashed, so bad codes cost no bcrypt and a code can never be used twice;
+// it's put back if the account can't be created after all.
+func (s *chatServer) register(username, password, code string) error {
+	if s.isReserved(username) { return errReservedName }
+	if !allowedUser(username) { return errors.New("only bilal and zohaib can be registered") }
+	if password == "" { return errors.New("empty password") }
+	var exists int
+	_ = s.db.QueryRow(`SELECT 1 FROM users WHERE username=?`, username).Scan(&exists)
+	if exists == 1 { return errors.New("username already taken") }
+
+	var by, expires string
+	err := s.db.QueryRow(`DELETE FROM invites WHERE code=? AND expires_at > CURRENT_TIMESTAMP
+RETURNING created_by, strftime('%Y-%m-%d %H:%M:%S', expires_at)`, code).Scan(&by, &expires)
+	if errors.Is(err, sql.ErrNoRows) { return errors.New("invalid or expired invite code") }
+	if err != nil { return err }
+	created := false
+	defer func() {
+		if !created { _, _ = s.execRetry(`INSERT OR IGNORE INTO invites(code, created_by, expires_at) VALUES(?,?,?)`, code, by, expires) }
+	}()
+
+	var h []byte
+	if busy := s.hashing(func() { h, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost) }); busy != nil { return busy }
+	if err != nil { return err }
+	if _, err := s.db.Exec(`INSERT INTO users(username, password_hash) VALUES(?,?)`, username, h); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") { return errors.New("username already taken") }
+		return err
+	}
+	created = true
+	return nil
+}
+
+func (s *chatServer) userCount() int {
+	var n int
+	_ = s.db.QueryRow(`SELECT COUNT(*) FROM users`).Scan(&n)
+	return n
+}
+
+// deleteAccount removes the user's row and, with purge, every message they sent.
+func (s *chatServer) deleteAccount(username string, purge bool) error {
+	tx, err := s.db.Begin()
+	if err != nil { return err }
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM users WHERE username=?`, username); err != nil { return err }
+	// the tombstone keeps seedUsers from re-creating a default account
+	if _, err := tx.Exec(`INSERT OR REPLACE INTO deleted_users(username) VALUES(?)`, username); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM blocks WHERE blocker=?`, username); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM user_prefs WHERE username=?`, username); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM snippets WHERE user=?`, username); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM read_marks WHERE user=?`, username); err != nil { return err }
+	if _, err := tx.Exec(`DELETE FROM aliases WHERE user=?`, username); err != nil { return err }
+	if purge {
+		if _, err := tx.Exec(`DELETE FROM messages WHERE sender=?`, username); err != nil { return err }
+	}
+	return tx.Commit()
+}
+
+// attach adds a session for username alongside any they already have, on
+// other devices, and reports whether it's their first.
+func (s *chatServer) attach(username string, conn net.Conn, w *outbox) (*userConn, bool) {
+	uc := &userConn{name: username, conn: conn, w: w, prefs: s.loadPrefs(username), since: time.Now()}
+	for k := range uc.prefs { uc.apply(k) }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first := len(s.clients[username]) == 0
+	if first { s.users[username] = &userState{} }
+	s.sessionSeq++
+	uc.id = s.sessionSeq
+	s.clients[username] = append(s.clients[username], uc)
+	return uc, first
+}
+
+// setAFK updates the user's away state and reports whether it changed.
+func (s *chatServer) setAFK(username string, afk bool, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.users[username]
+	if st == nil || (!afk && !st.afk) { return false }
+	st.afk, st.afkReason, st.afkNotified = afk, reason, false
+	return true
+}
+
+// sessions is a snapshot of username's connected sessions; empty if offline.
+func (s *chatServer) sessions(username string) []*userConn {
+	s.mu.Lock(); defer s.mu.Unlock()
+	return append([]*userConn(nil), s.clients[username]...)
+}
+
+// session is username's session writing to w, or nil.
+func (s *chatServer) session(username string, w *outbox) *userConn {
+	s.mu.Lock(); defer s.mu.Unlock()
+	for _, uc := range s.clients[username] {
+		if uc.w == w { return uc }
+	}
+	return nil
+}
+
+// primary is username's oldest session, or nil if they're offline. Prefs are
+// the same on every session, so it's where per-user settings are read from.
+// Callers hold s.mu.
+func (s *chatServer) primary(username string) *userConn {
+	if cs := s.clients[username]; len(cs) > 0 { return cs[0] }
+	return nil
+}
+
+// notifyUser sends notifySystem lines to every session of u and reports
+// whether u was online.
+func (s *chatServer) notifyUser(u string, lines ...string) bool {
+	cs := s.sessions(u)
+	for _, uc := range cs { s.notifySystem(uc, lines...) }
+	return len(cs) > 0
+}
+
+// detach removes the session writing to w and reports whether it was the
+// user's last. Pending video requests and calls only end with the last one.
+func (s *chatServer) detach(username string, w *outbox) bool {
+	s.mu.Lock()
+	cs := s.clients[username]
+	found := false
+	for i, uc := range cs {
+		if uc.w == w { cs, found = append(cs[:i:i], cs[i+1:]...), true; break }
+	}
+	if !found || len(cs) > 0 {
+		s.clients[username] = cs
+		s.mu.Unlock()
+		return false
+	}
+	delete(s.clients, username)
+	delete(s.users, username)
+	sids, others := s.dropCallsLocked(username)
+	s.mu.Unlock()
+	s.videoMu.Lock(); delete(s.videoReq, username); s.videoMu.Unlock() // clear pending prompts for this user
+
+	for _, u := range others {
+		s.notifyUser(u, fmt.Sprintf("Video session ended (%s left).", username))
+	}
+	for _, sid := range sids { go s.endVideoSession(sid) }
+	return true
+}
+
+// closeSessions detaches and disconnects username's sessions other than
+// keep, telling them why first.
+func (s *chatServer) closeSessions(username string, keep *outbox, why string) {
+	var others []*userConn
+	for _, uc := range s.sessions(username) {
+		if uc.w != keep { others = append(others, uc) }
+	}
+	for _, uc := range others {
+		s.detach(username, uc.w)
+		systemLine(uc.w, why)
+		uc.w.close()
+	}
+}
+
+func (s *chatServer) peerOf(u string) string {
+	if u == bilalUser { return zohaibUser }
+	return bilalUser
+}
+
+// errPeerOffline means the message was stored but the peer isn't connected.
+// errDBBusy means the database stayed locked through every retry and the
+// message was not stored at all.
+// errBlocked means the recipient has blocked the sender, and errInboxFull that
+// they already have -max-queued undelivered messages; either way nothing was stored.
+// errDuplicate means -dedup-window caught a repeat of the previous message.
+// errSlowMode means /slowmode is on and the sender's last message was too
+// recent; it's wrapped with how long to wait.
+// errDraining means /drain has started and nothing new is stored.
+var (
+	errPeerOffline = errors.New("peer offline")
+	errDBBusy      = errors.New("database busy")
+	errBlocked     = errors.New("blocked by recipient")
+	errInboxFull   = errors.New("recipient's inbox is full")
+	errDuplicate   = errors.New("duplicate message")
+	errSlowMode    = errors.New("slow mode")
+	errDraining    = errors.New("server is restarting")
+	errBadPassword = errors.New("invalid credentials")
+	errServerBusy  = errors.New("server busy, retry")
+)
+
+// insertRetries and insertBackoff bound the retry loop around message inserts:
+// 3 attempts waiting 50ms, then 100ms, between them.
+const (
+	insertRetries = 3
+	insertBackoff = 50 * time.Millisecond
+)
+
+// isBusy reports whether err is SQLite's SQLITE_BUSY or SQLITE_LOCKED, i.e.
+// another writer held the lock past busy_timeout and the write may succeed later.
+func isBusy(err error) bool {
+	var se interface{ Code() int }
+	if !errors.As(err, &se) { return false }
+	code := se.Code() & 0xff // extended result codes keep the primary code in the low byte
+	return code == 5 || code == 6
+}
+
+// execRetry runs an Exec, retrying with exponential backoff while the database
+// is busy. Other errors are returned immediately; exhausting the retries
+// returns an error wrapping errDBBusy.
+func (s *chatServer) execRetry(query string, args ...any) (sql.Result, error) {
+	wait := insertBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := s.db.Exec(query, args...)
+		if err == nil || !isBusy(err) { return res, err }
+		if attempt == insertRetries { return nil, fmt.Errorf("%w after %d attempts: %v", errDBBusy, attempt, err) }
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// isDuplicate reports whether text repeats from's previous stored message
+// within -dedup-window.
+func (s *chatServer) isDuplicate(from, text string, action bool) bool {
+	if s.opts.dedupWindow <= 0 { return false }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.users[from]
+	if st == nil { return false }
+	return st.lastText == dedupKey(text, action) && time.Since(st.lastAt) < s.opts.dedupWindow
+}
+
+// recordSent makes text from's previous message for isDuplicate, once it's
+// stored; a send that failed shouldn't block the retry.
+func (s *chatServer) recordSent(from, text string, action bool) {
+	if s.opts.dedupWindow <= 0 { return }
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.users[from]; st != nil { st.lastText, st.lastAt = dedupKey(text, action), time.Now() }
+}
+
+// dedupKey tells "/me waves" apart from "waves".
+func dedupKey(text string, action bool) string {
+	if action { return "\x00me " + text }
+	return text
+}
+
+// checkSlowMode enforces /slowmode: it returns errSlowMode if from sent a
+// message less than the interval ago. Otherwise, with record, it counts this
+// one as sent; without, it only checks ahead of work the send would waste.
+func (s *chatServer) checkSlowMode(from string, record bool) error {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.users[from]
+	if st == nil || s.slowMode <= 0 { return nil }
+	if left := st.lastSent.Add(s.slowMode).Sub(now); left > 0 {
+		return fmt.Errorf("%w: wait %d seconds", errSlowMode, int(math.Ceil(left.Seconds())))
+	}
+	if record { st.lastSent = now }
+	return nil
+}
+
+// countSent starts from's next /slowmode interval, for a send that checked
+// without recording and has since been stored.
+func (s *chatServer) countSent(from string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st := s.users[from]; st != nil { st.lastSent = time.Now() }
+}
+
+// loadSlowMode reads the /slowmode interval kept in server_settings.
+func loadSlowMode(db *sql.DB) (time.Duration, error) {
+	var secs int
+	err := db.QueryRow(`SELECT value FROM server_settings WHERE key='slow_mode'`).Scan(&secs)
+	if errors.Is(err, sql.ErrNoRows) { return 0, nil }
+	return time.Duration(secs) * time.Second, err
+}
+
+// handleSlowMode is /slowmode [seconds|off] (admin): pace everyone to one
+// message per interval. It's kept in server_settings, so it lasts until changed.
+func (s *chatServer) handleSlowMode(w *outbox, username, arg string) {
+	if arg == "" {
+		s.mu.Lock(); d := s.slowMode; s.mu.Unlock()
+		if d <= 0 { systemLine(w, "Slow mode is off.") } else { systemLine(w, fmt.Sprintf("Slow mode: one message every %d seconds.", int(d.Seconds()))) }
+		return
+	}
+	if username != s.opts.admin { errorLine(w, "Only the admin can change slow mode."); return }
+	secs := 0
+	if arg != "off" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 || n > 3600 { errorLine(w, "Usage: /slowmode <seconds 0-3600>|off"); return }
+		secs = n
+	}
+	if _, err := s.execRetry(`INSERT INTO server_settings(key, value) VALUES('slow_mode', ?)
+ON CONFLICT(key) DO UPDATE SET value=excluded.value`, strconv.Itoa(secs)); err != nil {
+		log.Printf("slow mode: %v\n", err)
+		errorLine(w, "Could not save slow mode.")
+		return
+	}
+	s.mu.Lock(); s.slowMode = time.Duration(secs) * time.Second; s.mu.Unlock()
+	if secs == 0 {
+		systemLine(w, "Slow mode off.")
+		s.broadcastPresence(username, "turned slow mode off.")
+		return
+	}
+	systemLine(w, fmt.Sprintf("Slow mode on: one message every %d seconds.", secs))
+	s.broadcastPresence(username, fmt.Sprintf("turned slow mode on: one message every %d seconds.", secs))
+}
+
+// makeRoom enforces -max-queued for recipient before a new message is stored:
+// at the cap it returns errInboxFull, or with -queue-full=drop-oldest deletes the
+// oldest undelivered messages until there's space.
+func (s *chatServer) makeRoom(recipient string) error {
+	if s.opts.maxQueued <= 0 { return nil }
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE recipient=? AND delivered=0`, recipient).Scan(&n); err != nil {
+		return fmt.Errorf("db: %w", err)
+	}
+	if n < s.opts.maxQueued { return nil }
+	if !s.opts.dropOldest { return errInboxFull }
+	_, err := s.execRetry(`DELETE FROM messages WHERE id IN (
+SELECT id FROM messages WHERE recipient=? AND delivered=0 ORDER BY ts, id LIMIT ?)`, recipient, n-s.opts.maxQueued+1)
+	if err != nil { return fmt.Errorf("db: %w", err) }
+	log.Printf("Queue for %s full; dropped %d oldest undelivered message(s)\n", recipient, n-s.opts.maxQueued+1)
+	return nil
+}
+
+// msgOpts are the variations on a plain chat message.
+type msgOpts struct {
+	action        bool  // /me
+	ack           bool  // /ack-request: the peer must /ack it
+	forwardedFrom int64 // /forward: the messages.id this copies (0 = not a forward)
+	replyTo       int64 // /reply: the messages.id this answers (0 = not a reply)
+	threadID      int64 // /thread post: the threads.id it belongs to (0 = none)
+}
+
+// sendToPeer stores a message and delivers it if the peer is online. The id is
+// valid whenever the message was stored, including with errPeerOffline.
+func (s *chatServer) sendToPeer(from, text string, o msgOpts) (int64, error) {
+	action := o.action
+	peer := s.peerOf(from)
+	if s.draining.Load() { return 0, errDraining }
+	if s.isBlocked(peer, from) { return 0, errBlocked }
+	if s.isDuplicate(from, text, action) { return 0, errDuplicate }
+	if err := s.checkSlowMode(from, false); err != nil { return 0, err }
+	if err := s.makeRoom(peer); err != nil { return 0, err }
+
+	// persist first
+	kind := kindChat
+	if action { kind = kindAction }
+	now := time.Now().UTC().Format(dbTimeLayout)
+	var sig, fwd, reply, thread any
+	if s.opts.signKey != nil { sig = signMessage(s.opts.signKey, from, peer, text, now, kind, action) }
+	if o.forwardedFrom != 0 { fwd = o.forwardedFrom }
+	if o.replyTo != 0 { reply = o.replyTo }
+	if o.threadID != 0 { thread = o.threadID }
+	res, err := s.execRetry(`INSERT INTO messages(sender, recipient, text, ts, delivered, is_action, kind, sig, ack_required, forwarded_from, reply_to, thread_id) VALUES(?,?,?,?,0,?,?,?,?,?,?,?)`, from, peer, text, now, action, kind, sig, o.ack, fwd, reply, thread)
+	if err != nil { return 0, fmt.Errorf("db: %w", err) }
+	s.recordSent(from, text, action)
+	s.countSent(from)
+	id, _ := res.LastInsertId()
+	if !s.deliverLive(id, from, text, time.Now(), o) { return id, errPeerOffline }
+	return id, nil
+}
+
+// deliverLive shows stored message id to every session of from's peer and
+// marks it delivered, reporting false if the peer has none. sent is when it
+// was sent, for the timestamp.
+func (s *chatServer) deliverLive(id int64, from, text string, sent time.Time, o msgOpts) bool {
+	peer := s.peerOf(from)
+	dsts := s.sessions(peer)
+	if len(dsts) == 0 { return false }
+	ts := s.stamp(peer, sent)
+	quote, label := s.quote(o.replyTo), s.threadLabel(o.threadID)
+	for _, dst := range dsts {
+		s.mu.Lock(); width, bell := dst.width, dst.bell; s.mu.Unlock()
+		if bell { dst.w.send(bel) }
+		s.notify(dst, s.userColor(from), withQuote(label, withQuote(quote, liveLines(dst.w, from, peer, text, ts, o.action, width)))...)
+		if o.ack { s.notifySystem(dst, ackPrompt(id)) }
+	}
+	s.markDelivered(id)
+	return true
+}
+
+// resend is /resend: another live delivery attempt for username's newest
+// message the peer hasn't received, without storing it again.
+func (s *chatServer) resend(w *outbox, username string) error {
+	s.flushDelivered() // so a message delivered a moment ago isn't picked
+	var id int64
+	var text, full string
+	var o msgOpts
+	var reply, thread sql.NullInt64
+	err := s.db.QueryRow(`SELECT id, text, strftime('%Y-%m-%d %H:%M:%S', ts), is_action, ack_required, reply_to, thread_id
+FROM messages WHERE sender=? AND recipient=? AND delivered=0 AND kind!=? ORDER BY id DESC LIMIT 1`, username, s.peerOf(username), kindSystem).Scan(&id, &text, &full, &o.action, &o.ack, &reply, &thread)
+	if err != nil { return errors.New("Nothing to resend: " + s.peerOf(username) + " has received all your messages.") }
+	o.replyTo, o.threadID = reply.Int64, thread.Int64
+	sent, perr := time.Parse(dbTimeLayout, full)
+	if perr != nil { sent = time.Now() }
+	if !s.deliverLive(id, username, text, sent, o) { return fmt.Errorf("%s is still offline; #%d stays queued.", s.peerOf(username), id) }
+	systemLine(w, fmt.Sprintf("Resent #%d.", id))
+	return nil
+}
+
+// relay sends a message to the peer and reports to the sender when it was only
+// queued, including the peer's auto-reply if they left one.
+func (s *chatServer) relay(w *outbox, from, text string, o msgOpts) {
+	id, err := s.sendToPeer(from, text, o)
+	if errors.Is(err, errDuplicate) {
+		systemLine(w, "(duplicate suppressed)")
+		return
+	}
+	if errors.Is(err, errSlowMode) {
+		errorLine(w, err.Error()+".")
+		return
+	}
+	if errors.Is(err, errInboxFull) {
+		errorLine(w, "Message not sent: "+s.peerOf(from)+"'s inbox is full.")
+		return
+	}
+	if errors.Is(err, errBlocked) {
+		systemLine(w, "You are blocked by "+s.peerOf(from))
+		return
+	}
+	if errors.Is(err, errDraining) {
+		errorLine(w, "Message not sent: the server is restarting. Reconnect in a moment.")
+		return
+	}
+	if errors.Is(err, errDBBusy) {
+		log.Println("send:", err)
+		errorLine(w, "Server is busy, message not sent. Please try again.")
+		return
+	}
+	if err != nil && !errors.Is(err, errPeerOffline) {
+		log.Println("send:", err)
+		errorLine(w, "Failed to send message.")
+		return
+	}
+	s.mu.Lock(); uc := s.primary(from); echo := uc != nil && uc.echo; s.mu.Unlock()
+	if echo {
+		if l := s.threadLabel(o.threadID); l != "" { writeLine(w, gray, l) }
+		if q := s.quote(o.replyTo); q != "" { writeLine(w, gray, q) }
+		writeLine(w, gray, formatMessage(w, s.stamp(from, time.Now()), from, text, o.action))
+	}
+	if o.ack { systemLine(w, fmt.Sprintf("Sent #%d, awaiting acknowledgment.", id)) }
+	if err != nil {
+		systemLine(w, "Peer is offline (message queued).")
+		peer := s.peerOf(from)
+		s.mu.Lock(); ar, ok := s.autoReply[peer]; s.mu.Unlock()
+		if ok { systemLine(w, fmt.Sprintf("%s (auto): %s", peer, ar.text)) }
+		return
+	}
+
+	peer := s.peerOf(from)
+	s.mu.Lock()
+	var notice string
+	if st := s.users[peer]; st != nil && st.afk && !st.afkNotified {
+		st.afkNotified = true
+		notice = peer + " is AFK"
+		if st.afkReason != "" { notice += ": " + st.afkReason }
+	}
+	s.mu.Unlock()
+	if notice != "" { systemLine(w, notice) }
+}
+
+// handleDraft keeps one unsent message per connection: /draft save <text>
+// stages it, /draft show prints it, /draft send relays it like a typed message
+// and /draft clear drops it.
+func (s *chatServer) handleDraft(w *outbox, username, arg string) {
+	sub, text, _ := strings.Cut(arg, " ")
+	uc := s.session(username, w)
+	if uc == nil { return }
+	switch sub {
+	case "save":
+		if text = strings.TrimSpace(text); text == "" { errorLine(w, "Usage: /draft save <text>"); return }
+		s.mu.Lock(); uc.draft = text; s.mu.Unlock()
+		systemLine(w, "Draft saved. /draft send when you're ready.")
+	case "show", "send", "clear":
+		s.mu.Lock(); d := uc.draft; if sub != "show" { uc.draft = "" }; s.mu.Unlock()
+		switch {
+		case d == "":
+			systemLine(w, "No draft saved.")
+		case sub == "show":
+			systemLine(w, "Draft: "+d)
+		case sub == "send":
+			s.relay(w, username, d, msgOpts{})
+		default:
+			systemLine(w, "Draft cleared.")
+		}
+	default:
+		errorLine(w, "Usage: /draft save <text> | /draft show | /draft send | /draft clear")
+	}
+}
+
+// notSavedMark labels /dm messages, which skip the messages table entirely.
+const notSavedMark = "(not saved) "
+
+// sendEphemeral is /dm: the message goes straight to the peer's connection with
+// no INSERT, so it never shows up in history, search or offline delivery. If the
+// peer is offline it's dropped.
+func (s *chatServer) sendEphemeral(w *outbox, from, text string) {
+	peer := s.peerOf(from)
+	if s.draining.Load() { errorLine(w, "Message not sent: the server is restarting. Reconnect in a moment."); return }
+	if s.isBlocked(peer, from) { systemLine(w, "You are blocked by "+peer); return }
+	dsts := s.sessions(peer)
+	if len(dsts) == 0 { systemLine(w, "Peer is offline; /dm not delivered (nothing was saved)."); return }
+	if err := s.checkSlowMode(from, true); err != nil { errorLine(w, err.Error()+"."); return }
+	now := time.Now()
+	for _, dst := range dsts {
+		s.mu.Lock(); width, bell := dst.width, dst.bell; s.mu.Unlock()
+		if bell { dst.w.send(bel) }
+		s.notify(dst, s.userColor(from), wrapMessage(notSavedMark+mentionMark(text, peer)+dst.w.header(s.stamp(peer, now), from, false), text, width)...)
+	}
+	s.mu.Lock(); uc := s.primary(from); echo := uc != nil && uc.echo; s.mu.Unlock()
+	if echo { writeLine(w, gray, notSavedMark+formatMessage(w, s.stamp(from, now), from, text, false)) }
+}
+
+// ===== Auto-reply =====
+// /autoreply <text> sets an out-of-office style reply shown to anyone who messages
+// the user while they're offline. It's cleared on the next login unless set with
+// /autoreply persist <text>.
+
+func (s *chatServer) handleAutoReply(w *outbox, username, arg string) {
+	switch {
+	case arg == "":
+		s.mu.Lock(); ar, ok := s.autoReply[username]; s.mu.Unlock()
+		if !ok { systemLine(w, "No auto-reply set. Usage: /autoreply [persist] <text> | /autoreply off"); return }
+		kind := "until next login"
+		if ar.persistent { kind = "persistent" }
+		systemLine(w, fmt.Sprintf("Auto-reply (%s): %s", kind, ar.text))
+	case arg == "off":
+		s.mu.Lock(); delete(s.autoReply, username); s.mu.Unlock()
+		systemLine(w, "Auto-reply cleared.")
+	default:
+		ar := autoReply{text: arg}
+		if rest, ok := strings.CutPrefix(arg, "persist "); ok {
+			ar = autoReply{text: strings.TrimSpace(rest), persistent: true}
+		}
+		if ar.text == "" { errorLine(w, "Usage: /autoreply [persist] <text> | /autoreply off"); return }
+		s.mu.Lock(); s.autoReply[username] = ar; s.mu.Unlock()
+		systemLine(w, "Auto-reply set.")
+	}
+}
+
+// snippetNameRe, maxSnippets and maxSnippetBytes bound what /snippet stores per user.
+var snippetNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+const (
+	maxSnippets     = 50
+	maxSnippetBytes = 1000
+)
+
+const snippetUsage = "Usage: /snippet save <name> <text> | /snippet list | /snippet send <name> | /snippet delete <name>"
+
+// handleSnippet is /snippet: named canned messages kept in the snippets table.
+// send goes through relay, exactly as if the text had been typed.
+func (s *chatServer) handleSnippet(w *outbox, username string, args []string, rest string) error {
+	if len(args) == 0 { return errors.New(snippetUsage) }
+	switch args[0] {
+	case "list":
+		rows, err := s.db.Query(`SELECT name, text FROM snippets WHERE user=? ORDER BY name`, username)
+		if err != nil { return errors.New("Could not load snippets.") }
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			var name, text string
+			if rows.Scan(&name, &text) != nil { continue }
+			if n++; n == 1 { systemLine(w, "Snippets:") }
+			systemLine(w, "  "+name+": "+excerpt(text, quoteLen))
+		}
+		if n == 0 { systemLine(w, "No snippets saved. /snippet save <name> <text>") }
+		return nil
+	case "save":
+		if len(args) < 3 || !snippetNameRe.MatchString(args[1]) { return errors.New("Usage: /snippet save <name> <text>  (name: up to 32 letters, digits, - or _)") }
+		_, text, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(rest, "save")), " ")
+		text = strings.TrimSpace(text)
+		if len(text) > maxSnippetBytes { return fmt.Errorf("Snippets are limited to %d bytes.", maxSnippetBytes) }
+		var count int
+		var exists bool
+		_ = s.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(name=?), 0) FROM snippets WHERE user=?`, args[1], username).Scan(&count, &exists)
+		if !exists && count >= maxSnippets { return fmt.Errorf("You already have %d snippets; /snippet delete one first.", maxSnippets) }
+		if _, err := s.execRetry(`INSERT INTO snippets(user, name, text) VALUES(?, ?, ?)
+ON CONFLICT(user, name) DO UPDATE SET text=excluded.text`, username, args[1], text); err != nil { return errors.New("Could not save the snippet.") }
+		systemLine(w, "Snippet "+args[1]+" saved. /snippet send "+args[1]+" to send it.")
+		return nil
+	case "send", "delete":
+		if len(args) != 2 { return errors.New("Usage: /snippet " + args[0] + " <name>") }
+		if args[0] == "delete" {
+			res, err := s.execRetry(`DELETE FROM snippets WHERE user=? AND name=?`, username, args[1])
+			if err != nil { return errors.New("Could not delete the snippet.") }
+			if n, _ := res.RowsAffected(); n == 0 { return errors.New("No snippet named " + args[1] + ".") }
+			systemLine(w, "Snippet "+args[1]+" deleted.")
+			return nil
+		}
+		if err := s.checkSlowMode(username, false); err != nil { return errors.New(err.Error() + ".") }
+		var text string
+		if err := s.db.QueryRow(`SELECT text FROM snippets WHERE user=? AND name=?`, username, args[1]).Scan(&text); err != nil {
+			return errors.New("No snippet named " + args[1] + ".")
+		}
+		s.relay(w, username, text, msgOpts{})
+		return nil
+	}
+	return errors.New(snippetUsage)
+}
+
+// clearAutoReply drops a non-persistent auto-reply once its owner is back online.
+func (s *chatServer) clearAutoReply(w *outbox, username string) {
+	s.mu.Lock()
+	ar, ok := s.autoReply[username]
+	if ok && !ar.persistent { delete(s.autoReply, username) }
+	s.mu.Unlock()
+	if ok && !ar.persistent { systemLine(w, "Your auto-reply was cleared.") }
+}
+
+// parseMessageID reads a single "<id>" or "#<id>" argument.
+func parseMessageID(args []string) (int64, bool) {
+	if len(args) != 1 { return 0, false }
+	id, err := strconv.ParseInt(strings.TrimPrefix(args[0], "#"), 10, 64)
+	return id, err == nil && id > 0
+}
+
+// forward is /forward: relay a copy of message id, which username must be a
+// party to, to target with the original sender credited.
+func (s *chatServer) forward(w *outbox, username string, id int64, target string) {
+	if !allowedUser(target) { errorLine(w, "No such user "+target+"."); return }
+	if target == username { errorLine(w, "You can't forward a message to yourself."); return }
+	var sender, text string
+	var action bool
+	err := s.db.QueryRow(`SELECT sender, text, is_action FROM messages
+WHERE id=? AND (sender=? OR recipient=?) AND kind!=?`, id, username, username, kindSystem).Scan(&sender, &text, &action)
+	if err != nil { errorLine(w, fmt.Sprintf("No message #%d.", id)); return }
+	if action { text = "* " + sender + " " + text }
+	s.relay(w, username, "(forwarded from "+sender+") "+text, msgOpts{forwardedFrom: id})
+}
+
+// reply is /reply: send text to the peer linked to message id (reply_to), which
+// must be a chat message or action in the conversation.
+func (s *chatServer) reply(w *outbox, username string, id int64, text string) {
+	var ok int
+	err := s.db.QueryRow(`SELECT 1 FROM messages WHERE id=? AND kind!=?
+  AND sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')`, id, kindSystem).Scan(&ok)
+	if err != nil { errorLine(w, fmt.Sprintf("No message #%d.", id)); return }
+	s.relay(w, username, text, msgOpts{replyTo: id})
+}
+
+// quoteLen caps the excerpt of the original shown above a reply, in runes.
+const quoteLen = 60
+
+// quote is the "> sender: excerpt" line shown above a reply to message id, or
+// "" for id 0. It reads the original at render time, so edits show through.
+func (s *chatServer) quote(id int64) string {
+	if id == 0 { return "" }
+	var sender, text string
+	var action bool
+	if s.db.QueryRow(`SELECT sender, text, is_action FROM messages WHERE id=?`, id).Scan(&sender, &text, &action) != nil {
+		return fmt.Sprintf("> (message #%d was deleted)", id)
+	}
+	text = excerpt(text, quoteLen)
+	if action { return "> * " + sender + " " + text }
+	return "> " + sender + ": " + text
+}
+
+// excerpt is text on one line, cut to n runes with a trailing "…".
+func excerpt(text string, n int) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > n { text = string(r[:n]) + "…" }
+	return text
+}
+
+// withQuote puts quote, if any, above a message's lines.
+func withQuote(quote string, lines []string) []string {
+	if quote == "" { return lines }
+	return append([]string{quote}, lines...)
+}
+
+// ===== Aliases =====
+// /alias stores per-user shortcuts in the aliases table. A target always
+// starts with a built-in command, so expansion is one step and can't loop, and
+// a built-in name can't be shadowed.
+
+// aliasNameRe is what an alias may be called, without its leading "/".
+var aliasNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,32}$`)
+
+const (
+	maxAliases     = 50
+	maxAliasTarget = 200
+	aliasUsage     = "Usage: /alias <name> <command> [args] | /alias list"
+)
+
+// expandAlias rewrites line when its first word is one of username's aliases:
+// the target followed by whatever was typed after the alias.
+func (s *chatServer) expandAlias(username, line string) (string, bool) {
+	name, rest, _ := strings.Cut(line, " ")
+	if !strings.HasPrefix(name, "/") { return "", false }
+	if _, builtin := commands[name]; builtin { return "", false }
+	var target string
+	if err := s.db.QueryRow(`SELECT target FROM aliases WHERE user=? AND name=?`, username, name[1:]).Scan(&target); err != nil { return "", false }
+	return strings.TrimSpace(target + " " + rest), true
+}
+
+func (s *chatServer) handleAlias(w *outbox, username string, args []string, rest string) error {
+	if len(args) == 0 || (len(args) == 1 && args[0] == "list") {
+		rows, err := s.db.Query(`SELECT name, target FROM aliases WHERE user=? ORDER BY name`, username)
+		if err != nil { return errors.New("Could not load aliases.") }
+		defer rows.Close()
+		n := 0
+		for rows.Next() {
+			var name, target string
+			if rows.Scan(&name, &target) != nil { continue }
+			if n++; n == 1 { systemLine(w, "Aliases:") }
+			systemLine(w, "  /"+name+" -> "+target)
+		}
+		if n == 0 { systemLine(w, "No aliases. /alias <name> <command>, e.g. /alias h /history") }
+		return nil
+	}
+	if len(args) < 2 { return errors.New(aliasUsage) }
+	name := strings.TrimPrefix(args[0], "/")
+	if !aliasNameRe.MatchString(name) || name == "list" { return errors.New("Alias names are up to 32 letters, digits, - or _ (and not \"list\").") }
+	if _, builtin := commands["/"+name]; builtin { return errors.New("/" + name + " is a built-in command; pick another name.") }
+	_, target, _ := strings.Cut(strings.TrimSpace(rest), " ")
+	target = strings.TrimSpace(target)
+	if !strings.HasPrefix(target, "/") { target = "/" + target }
+	cmd, _, _ := strings.Cut(target, " ")
+	if _, builtin := commands[cmd]; !builtin {
+		var other int
+		_ = s.db.QueryRow(`SELECT COUNT(*) FROM aliases WHERE user=? AND name=?`, username, cmd[1:]).Scan(&other)
+		if other > 0 { return errors.New("Aliases must point at a built-in command, not another alias (" + cmd + ").") }
+		return errors.New("No such command: " + cmd + ". Type /help for the list.")
+	}
+	if len(target) > maxAliasTarget { return fmt.Errorf("Alias commands are limited to %d bytes.", maxAliasTarget) }
+	var count int
+	var exists bool
+	_ = s.db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(name=?), 0) FROM aliases WHERE user=?`, name, username).Scan(&count, &exists)
+	if !exists && count >= maxAliases { return fmt.Errorf("You already have %d aliases; /unalias one first.", maxAliases) }
+	if _, err := s.execRetry(`INSERT INTO aliases(user, name, target) VALUES(?, ?, ?)
+ON CONFLICT(user, name) DO UPDATE SET target=excluded.target`, username, name, target); err != nil { return errors.New("Could not save the alias.") }
+	systemLine(w, "Alias /"+name+" -> "+target+" saved.")
+	return nil
+}
+
+// ===== Threads =====
+// A thread is a topic in the threads table; /thread post sends an ordinary
+// message with messages.thread_id set, and every rendering of it carries a
+// "» thread #id topic" label so parallel topics stay apart in one conversation.
+
+// maxTopic caps a thread topic, in runes.
+const maxTopic = 80
+
+// threadLabel is the line shown above a message in thread id, or "" for 0.
+func (s *chatServer) threadLabel(id int64) string {
+	if id == 0 { return "" }
+	var topic string
+	if s.db.QueryRow(`SELECT topic FROM threads WHERE id=?`, id).Scan(&topic) != nil { return fmt.Sprintf("» thread #%d", id) }
+	return fmt.Sprintf("» thread #%d %s", id, topic)
+}
+
+func (s *chatServer) newThread(w *outbox, username, topic string) error {
+	if topic == "" { return errors.New("Usage: /thread new <topic>") }
+	if utf8.RuneCountInString(topic) > maxTopic { return fmt.Errorf("Topics are limited to %d characters.", maxTopic) }
+	res, err := s.execRetry(`INSERT INTO threads(topic, creator) VALUES(?, ?)`, topic, username)
+	if err != nil { return errors.New("Could not create the thread.") }
+	id, _ := res.LastInsertId()
+	systemLine(w, fmt.Sprintf("Thread #%d %q started. /thread post %d <text> to write in it.", id, topic, id))
+	s.notifyUser(s.peerOf(username), fmt.Sprintf("%s started thread #%d: %s", username, id, topic))
+	return nil
+}
+
+func (s *chatServer) postThread(w *outbox, username string, id int64, text string) error {
+	if text == "" { return errors.New("Usage: /thread post <id> <text>") }
+	var closed sql.NullString
+	if s.db.QueryRow(`SELECT closed_at FROM threads WHERE id=?`, id).Scan(&closed) != nil { return fmt.Errorf("No thread #%d.", id) }
+	if closed.Valid { return fmt.Errorf("Thread #%d is closed.", id) }
+	s.relay(w, username, text, msgOpts{threadID: id})
+	return nil
+}
+
+func (s *chatServer) closeThread(w *outbox, username string, id int64) error {
+	res, err := s.execRetry(`UPDATE threads SET closed_at=CURRENT_TIMESTAMP WHERE id=? AND closed_at IS NULL`, id)
+	if err != nil { return errors.New("Could not close the thread.") }
+	if n, _ := res.RowsAffected(); n == 0 { return fmt.Errorf("No open thread #%d.", id) }
+	systemLine(w, fmt.Sprintf("Thread #%d closed.", id))
+	s.notifyUser(s.peerOf(username), fmt.Sprintf("%s closed thread #%d.", username, id))
+	return nil
+}
+
+// listThreads is /thread list: open threads, most recently active first.
+func (s *chatServer) listThreads(w *outbox, username string) {
+	rows, err := s.db.Query(`
+SELECT t.id, t.topic, t.creator, COUNT(m.id), strftime('%Y-%m-%d %H:%M:%S', COALESCE(MAX(m.ts), t.created_at))
+FROM threads t LEFT JOIN messages m ON m.thread_id = t.id
+WHERE t.closed_at IS NULL
+GROUP BY t.id ORDER BY COALESCE(MAX(m.ts), t.created_at) DESC, t.id DESC`)
+	if err != nil { errorLine(w, "Could not load threads."); return }
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var id int64
+		var topic, creator, last string
+		var count int
+		if rows.Scan(&id, &topic, &creator, &count, &last) != nil { continue }
+		n++
+		systemLine(w, fmt.Sprintf("#%d %s (by %s, %d message(s), last %s)", id, topic, creator, count, s.dbStamp(username, last)))
+	}
+	if n == 0 { systemLine(w, "No open threads. /thread new <topic> to start one.") }
+}
+
+// viewThread is /thread view: the thread's messages oldest first, under one
+// heading instead of a label on each.
+func (s *chatServer) viewThread(w *outbox, username string, id int64) error {
+	var topic string
+	if s.db.QueryRow(`SELECT topic FROM threads WHERE id=?`, id).Scan(&topic) != nil { return fmt.Errorf("No thread #%d.", id) }
+	rows := s.queryHistory(` AND thread_id=? ORDER BY id`, id)
+	for i := range rows { rows[i].thread = sql.NullInt64{} }
+	systemLine(w, fmt.Sprintf("Thread #%d %s: %d message(s)", id, topic, len(rows)))
+	s.printRows(w, username, rows, 0)
+	return nil
+}
+
+// ===== Acknowledgments =====
+// /ack-request sends a message with ack_required set; the recipient answers
+// with /ack <id>, which stamps acked_at and tells the sender. Until then
+// remindAcks nudges both sides every -ack-remind, unless they /set acks off.
+
+func ackPrompt(id int64) string {
+	return fmt.Sprintf("Acknowledgment requested: type /ack %d", id)
+}
+
+func (s *chatServer) ack(w *outbox, username string, id int64) {
+	res, err := s.execRetry(`UPDATE messages SET acked_at=CURRENT_TIMESTAMP
+WHERE id=? AND recipient=? AND ack_required=1 AND acked_at IS NULL`, id, username)
+	if err != nil { errorLine(w, "Could not record the acknowledgment."); return }
+	if n, _ := res.RowsAffected(); n == 0 {
+		errorLine(w, fmt.Sprintf("No message #%d awaiting your acknowledgment.", id))
+		return
+	}
+	systemLine(w, fmt.Sprintf("Acknowledged #%d.", id))
+	s.notifyUser(s.peerOf(username), fmt.Sprintf("%s acknowledged #%d.", username, id))
+}
+
+// remindAcks reminds online senders and recipients of every message that has
+// waited at least one interval for its /ack.
+func (s *chatServer) remindAcks(every time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop: return
+		case <-t.C:
+		}
+		cutoff := time.Now().UTC().Add(-every).Format(dbTimeLayout)
+		rows, err := s.db.Query(`SELECT id, sender, recipient FROM messages
+WHERE ack_required=1 AND acked_at IS NULL AND ts<=? ORDER BY id`, cutoff)
+		if err != nil { log.Printf("ack reminders: %v\n", err); continue }
+		type pending struct{ id int64; sender, recipient string }
+		var due []pending
+		for rows.Next() {
+			var p pending
+			if rows.Scan(&p.id, &p.sender, &p.recipient) == nil { due = append(due, p) }
+		}
+		rows.Close()
+		for _, p := range due {
+			s.remind(p.sender, fmt.Sprintf("Reminder: #%d is still awaiting acknowledgment from %s.", p.id, p.recipient))
+			s.remind(p.recipient, fmt.Sprintf("Reminder: %s is waiting for you to /ack %d.", p.sender, p.id))
+		}
+	}
+}
+
+func (s *chatServer) remind(u, line string) {
+	if s.pref(u, "acks") != "on" { return }
+	s.notifyUser(u, line)
+}
+
+// ===== Polls =====
+// /poll stores a yes/no question in polls and sends it to the peer as an
+// ordinary message, so it's queued like any other while they're offline.
+// /vote records one answer per voter in votes; the creator is told when it
+// arrives and both sides get the tally on /poll close.
+
+func (s *chatServer) startPoll(w *outbox, username, question string) error {
+	if question = strings.TrimSpace(question); question == "" { return errors.New("Usage: /poll <question> | /poll close [poll id]") }
+	// relay counts the message; checked first so a refused one leaves no poll behind
+	if err := s.checkSlowMode(username, false); err != nil { return errors.New(err.Error() + ".") }
+	res, err := s.execRetry(`INSERT INTO polls(creator, question) VALUES(?, ?)`, username, question)
+	if err != nil { return errors.New("Could not create the poll.") }
+	id, _ := res.LastInsertId()
+	s.relay(w, username, fmt.Sprintf("Poll #%d: %s  (answer with /vote yes|no)", id, question), msgOpts{})
+	return nil
+}
+
+// openPoll finds the open poll id, or when id is 0 the newest open poll
+// matching creatorCond ("creator=?" or "creator!=?" against username).
+func (s *chatServer) openPoll(id int64, creatorCond, username string) (pid int64, creator, question string, err error) {
+	q, args := `SELECT id, creator, question FROM polls WHERE closed_at IS NULL AND id=?`, []any{id}
+	if id == 0 { q, args = `SELECT id, creator, question FROM polls WHERE closed_at IS NULL AND `+creatorCond+` ORDER BY id DESC LIMIT 1`, []any{username} }
+	err = s.db.QueryRow(q, args...).Scan(&pid, &creator, &question)
+	return
+}
+
+// tally is "yes N, no M" for poll id, with who voted what.
+func (s *chatServer) tally(id int64) string {
+	rows, err := s.db.Query(`SELECT voter, vote FROM votes WHERE poll_id=? ORDER BY voted_at, voter`, id)
+	if err != nil { return "no tally" }
+	defer rows.Close()
+	yes, no := 0, 0
+	var who []string
+	for rows.Next() {
+		var voter, v string
+		if rows.Scan(&voter, &v) != nil { continue }
+		if v == "yes" { yes++ } else { no++ }
+		who = append(who, voter+": "+v)
+	}
+	t := fmt.Sprintf("yes %d, no %d", yes, no)
+	if len(who) > 0 { t += " (" + strings.Join(who, ", ") + ")" }
+	return t
+}
+
+func (s *chatServer) vote(w *outbox, username string, id int64, v string) error {
+	pid, creator, question, err := s.openPoll(id, "creator!=?", username)
+	if err != nil {
+		if id == 0 { return errors.New("No open poll to vote on.") }
+		return fmt.Errorf("No open poll #%d.", id)
+	}
+	// the creator is told of every vote, so votes are paced like messages
+	if creator != username {
+		if err := s.checkSlowMode(username, true); err != nil { return errors.New(err.Error() + ".") }
+	}
+	if _, err := s.execRetry(`INSERT INTO votes(poll_id, voter, vote) VALUES(?, ?, ?)
+ON CONFLICT(poll_id, voter) DO UPDATE SET vote=excluded.vote, voted_at=CURRENT_TIMESTAMP`, pid, username, v); err != nil {
+		return errors.New("Could not record your vote.")
+	}
+	systemLine(w, fmt.Sprintf("Voted %s on poll #%d.", v, pid))
+	if creator != username { s.notifyUser(creator, fmt.Sprintf("%s voted %s on poll #%d %q: %s.", username, v, pid, question, s.tally(pid))) }
+	return nil
+}
+
+func (s *chatServer) closePoll(w *outbox, username string, id int64) error {
+	pid, creator, question, err := s.openPoll(id, "creator=?", username)
+	if err != nil || creator != username {
+		if id == 0 { return errors.New("You have no open poll.") }
+		return fmt.Errorf("No open poll #%d of yours.", id)
+	}
+	if _, err := s.execRetry(`UPDATE polls SET closed_at=CURRENT_TIMESTAMP WHERE id=?`, pid); err != nil { return errors.New("Could not close the poll.") }
+	result := fmt.Sprintf("Poll #%d %q closed: %s.", pid, question, s.tally(pid))
+	systemLine(w, result)
+	s.notifyUser(s.peerOf(username), result)
+	return nil
+}
+
+// listPolls is /poll with no arguments: every open poll and its tally so far.
+func (s *chatServer) listPolls(w *outbox, username string) {
+	rows, err := s.db.Query(`SELECT id, creator, question FROM polls WHERE closed_at IS NULL ORDER BY id`)
+	if err != nil { errorLine(w, "Could not load polls."); return }
+	type poll struct{ id int64; creator, question string }
+	var open []poll
+	for rows.Next() {
+		var p poll
+		if rows.Scan(&p.id, &p.creator, &p.question) == nil { open = append(open, p) }
+	}
+	rows.Close()
+	if len(open) == 0 { systemLine(w, "No open polls. /poll <question> to ask one."); return }
+	for _, p := range open {
+		by := p.creator
+		if by == username { by = "you" }
+		systemLine(w, fmt.Sprintf("#%d %q by %s: %s", p.id, p.question, by, s.tally(p.id)))
+	}
+}
+
+// ===== Pins =====
+// Either participant can pin or unpin any message in the conversation by id.
+
+func (s *chatServer) setPinned(w *outbox, id int64, pinned bool) {
+	res, err := s.execRetry(`UPDATE messages SET pinned=? WHERE id=?
+  AND sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')`, pinned, id)
+	if errors.Is(err, errDBBusy) { errorLine(w, "Server busy, retry."); return }
+	if err != nil {
+		errorLine(w, "Could not update the pin.")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		errorLine(w, fmt.Sprintf("No message #%d.", id))
+		return
+	}
+	if pinned {
+		systemLine(w, fmt.Sprintf("Pinned #%d.", id))
+	} else {
+		systemLine(w, fmt.Sprintf("Unpinned #%d.", id))
+	}
+}
+
+func (s *chatServer) printPins(w *outbox, username string) {
+	rows, err := s.db.Query(`
+SELECT id, sender, text, strftime('%Y-%m-%d %H:%M:%S', ts), is_action
+FROM messages
+WHERE pinned=1 AND sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')
+ORDER BY ts ASC, id ASC`)
+	if err != nil { errorLine(w, "Could not load pins."); return }
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var id int64; var sdr, txt, hh string; var action bool
+		_ = rows.Scan(&id, &sdr, &txt, &hh, &action)
+		writeLine(w, s.userColor(sdr), fmt.Sprintf("#%d 📌 %s", id, formatMessage(w, s.dbStamp(username, hh), sdr, txt, action)))
+		count++
+	}
+	if count == 0 { systemLine(w, "No pinned messages.") }
+}
+
+// handleColor sets the user's display color (users.color) from the named palette.
+func (s *chatServer) handleColor(w *outbox, username, name string) {
+	name = strings.ToLower(name)
+	var stored any // NULL = back to the default
+	switch _, ok := colorNames[name]; {
+	case name == "reset":
+	case ok:
+		stored = name
+	default:
+		names := make([]string, 0, len(colorNames))
+		for n := range colorNames { names = append(names, n) }
+		sort.Strings(names)
+		errorLine(w, "Usage: /color <name|reset>  (one of: "+strings.Join(names, ", ")+")")
+		return
+	}
+	if _, err := s.execRetry(`UPDATE users SET color=? WHERE username=?`, stored, username); err != nil {
+		if errors.Is(err, errDBBusy) { errorLine(w, "Server busy, retry."); return }
+		errorLine(w, "Could not save your color.")
+		return
+	}
+	s.mu.Lock(); delete(s.userColors, username); s.mu.Unlock()
+	writeLine(w, s.userColor(username), "Your messages now show in this color.")
+}
+
+// handlePrompt sets the user's prompt format (users.prompt). Trailing spaces in
+// format are kept, since "%u> " and "%u>" read differently.
+func (s *chatServer) handlePrompt(w *outbox, username, format string) {
+	if format == "" {
+		systemLine(w, fmt.Sprintf("Prompt: %q. Usage: /prompt <format|reset>  (%%u you, %%p peer, %%t HH:MM, %%%% a literal %%)", s.promptFormat(username)))
+		return
+	}
+	var stored any // NULL = back to defaultPrompt
+	if format != "reset" {
+		format = sanitizeLine(format, maxPromptLen)
+		if strings.TrimSpace(format) == "" { systemLine(w, "Prompt format has nothing printable."); return }
+		stored = format
+	}
+	if _, err := s.execRetry(`UPDATE users SET prompt=? WHERE username=?`, stored, username); err != nil {
+		if errors.Is(err, errDBBusy) { errorLine(w, "Server busy, retry."); return }
+		errorLine(w, "Could not save your prompt.")
+		return
+	}
+	s.mu.Lock(); delete(s.userPrompts, username); s.mu.Unlock()
+	systemLine(w, "Prompt updated.")
+}
+
+// userStatus is u's /status text, or "".
+func (s *chatServer) userStatus(u string) string {
+	var st sql.NullString
+	_ = s.db.QueryRow(`SELECT status FROM users WHERE username=?`, u).Scan(&st)
+	return st.String
+}
+
+// withStatus appends a status (or AFK reason) to a presence line: "zohaib
+// joined — 🍜 at lunch".
+func withStatus(line, status string) string {
+	if status == "" { return line + "." }
+	return line + " — " + status
+}
+
+// handleStatus is /status [text|clear]; a change is shown to the peer if online.
+func (s *chatServer) handleStatus(w *outbox, username, text string) {
+	if text == "" {
+		st := s.userStatus(username)
+		if st == "" { st = "(none)" }
+		systemLine(w, "Your status: "+st+". Usage: /status <text>|clear")
+		return
+	}
+	var stored any // NULL = no status
+	if text != "clear" {
+		text = sanitizeLine(text, maxStatusLen)
+		if strings.TrimSpace(text) == "" { systemLine(w, "Status has nothing printable."); return }
+		stored = text
+	}
+	if _, err := s.execRetry(`UPDATE users SET status=? WHERE username=?`, stored, username); err != nil {
+		errorLine(w, "Could not save your status.")
+		return
+	}
+	if stored == nil {
+		systemLine(w, "Status cleared.")
+		s.broadcastPresence(username, "cleared their status.")
+		return
+	}
+	systemLine(w, "Status set: "+text)
+	s.broadcastPresence(username, "is now: "+text)
+}
+
+// printWho is /who: both users, online or not, with AFK and /status.
+func (s *chatServer) printWho(w *outbox, username string) {
+	for _, u := range []string{bilalUser, zohaibUser} {
+		s.mu.Lock()
+		n, st := len(s.clients[u]), s.users[u]
+		s.mu.Unlock()
+		state := "offline"
+		switch {
+		case n == 0:
+		case st != nil && st.afk: state = "AFK"
+		default: state = "online"
+		}
+		if n > 1 { state += fmt.Sprintf(" (%d sessions)", n) }
+		line := u
+		if u == username { line += " (you)" }
+		systemLine(w, withStatus(line+" "+state, s.userStatus(u)))
+	}
+}
+
+// listSessions is /sessions: username's connections, oldest first, marking the
+// one asking.
+func (s *chatServer) listSessions(w *outbox, username string) {
+	for _, uc := range s.sessions(username) {
+		line := fmt.Sprintf("#%d %s, logged in %s (%s ago)", uc.id, uc.conn.RemoteAddr(), s.stamp(username, uc.since), time.Since(uc.since).Round(time.Second))
+		if uc.w == w { line += " (this session)" }
+		systemLine(w, line)
+	}
+}
+
+// killSession is /sessions kill: it closes username's session id, which then
+// logs out like any dropped connection.
+func (s *chatServer) killSession(w *outbox, username string, id int64) error {
+	for _, uc := range s.sessions(username) {
+		if uc.id != id { continue }
+		if uc.w == w { return errors.New("That's this session; use /logout or /quit.") }
+		s.notifySystem(uc, "This session was closed from another of your sessions.")
+		uc.w.close()
+		log.Printf("%s closed their session #%d from %s\n", username, id, uc.conn.RemoteAddr())
+		systemLine(w, fmt.Sprintf("Session #%d closed.", id))
+		return nil
+	}
+	return fmt.Errorf("No session #%d. /sessions lists them.", id)
+}
+
+// whois is /whois: one user's profile, pieced together from users, presence,
+// messages and the login tables.
+func (s *chatServer) whois(w *outbox, viewer, u string) error {
+	var color sql.NullString
+	if s.db.QueryRow(`SELECT color FROM users WHERE username=?`, u).Scan(&color) != nil { return errors.New("No such user: " + u) }
+	role := "user"
+	if u == s.opts.admin { role = "admin" }
+	s.mu.Lock()
+	n, st := len(s.clients[u]), s.users[u]
+	afk, reason := st != nil && st.afk, ""
+	if afk { reason = st.afkReason }
+	s.mu.Unlock()
+	presence := "offline"
+	if ucs := s.sessions(u); n > 0 && len(ucs) > 0 {
+		presence = fmt.Sprintf("online for %s", time.Since(ucs[0].since).Round(time.Second))
+		if n > 1 { presence += fmt.Sprintf(" (%d sessions)", n) }
+		if afk { presence += ", AFK" }
+		if reason != "" { presence += ": " + reason }
+	} else {
+		var last sql.NullString
+		_ = s.db.QueryRow(`SELECT strftime('%Y-%m-%d %H:%M:%S', MAX(ts)) FROM login_audit WHERE username=? AND success=1`, u).Scan(&last)
+		if last.Valid { presence += ", last logged in " + s.dbDateStamp(viewer, last.String) }
+	}
+	if color.String == "" { color.String = "default" }
+	var sent int
+	_ = s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE sender=? AND kind!=?`, u, kindSystem).Scan(&sent)
+
+	systemLine(w, u+" ("+role+")")
+	systemLine(w, "  presence: "+presence)
+	if status := s.userStatus(u); status != "" { systemLine(w, "  status:   "+status) }
+	systemLine(w, "  color:    "+color.String)
+	systemLine(w, fmt.Sprintf("  messages: %d sent", sent))
+	if viewer != s.opts.admin { return nil }
+	var first, firstIP, lastAt, lastIP sql.NullString
+	_ = s.db.QueryRow(`SELECT strftime('%Y-%m-%d %H:%M:%S', first_seen), ip FROM login_ips WHERE username=? ORDER BY first_seen LIMIT 1`, u).Scan(&first, &firstIP)
+	_ = s.db.QueryRow(`SELECT strftime('%Y-%m-%d %H:%M:%S', ts), remote_addr FROM login_audit WHERE username=? AND success=1 ORDER BY rowid DESC LIMIT 1`, u).Scan(&lastAt, &lastIP)
+	if first.Valid { systemLine(w, "  first login: "+s.dbDateStamp(viewer, first.String)+" from "+firstIP.String) }
+	if lastAt.Valid { systemLine(w, "  last login:  "+s.dbDateStamp(viewer, lastAt.String)+" from "+lastIP.String) }
+	return nil
+}
+
+// isBlocked reports whether blocker has blocked blocked.
+func (s *chatServer) isBlocked(blocker, blocked string) bool {
+	var one int
+	_ = s.db.QueryRow(`SELECT 1 FROM blocks WHERE blocker=? AND blocked=?`, blocker, blocked).Scan(&one)
+	return one == 1
+}
+
+// handleBlock is /block and /unblock. A blocked user's messages to the blocker
+// are refused outright rather than stored.
+func (s *chatServer) handleBlock(w *outbox, username, target string, block bool) {
+	verb := "/unblock"
+	if block { verb = "/block" }
+	if target == "" { errorLine(w, "Usage: "+verb+" <user>"); return }
+	if target == username { systemLine(w, "You can't block yourself."); return }
+	var one int
+	if err := s.db.QueryRow(`SELECT 1 FROM users WHERE username=?`, target).Scan(&one); err != nil {
+		errorLine(w, "No such user: "+target)
+		return
+	}
+	q := `DELETE FROM blocks WHERE blocker=? AND blocked=?`
+	if block { q = `INSERT OR IGNORE INTO blocks(blocker, blocked) VALUES(?,?)` }
+	if _, err := s.execRetry(q, username, target); err != nil {
+		if errors.Is(err, errDBBusy) { errorLine(w, "Server busy, retry."); return }
+		errorLine(w, "Could not update blocks.")
+		return
+	}
+	if block { systemLine(w, "Blocked "+target+"; their messages to you will be refused.") } else { systemLine(w, "Unblocked "+target+".") }
+}
+
+// handleQueued reports how many messages are waiting for a user: the peer by
+// default, or any user for the admin.
+func (s *chatServer) handleQueued(w *outbox, username string, args []string) {
+	target := s.peerOf(username)
+	if len(args) > 0 {
+		if args[0] != target && username != s.opts.admin {
+			errorLine(w, "Only the admin can check other users' queues.")
+			return
+		}
+		target = args[0]
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE recipient=? AND delivered=0`, target).Scan(&n); err != nil {
+		errorLine(w, "Could not count queued messages.")
+		return
+	}
+	systemLine(w, fmt.Sprintf("%d message(s) waiting for %s.", n, target))
+}
+
+func (s *chatServer) deliverUndelivered(uc *userConn) {
+	toUser := uc.name
+	s.flushDelivered() // so messages already delivered live aren't shown again as missed
+	rows, err := s.missedRows(`recipient=? AND delivered=0`, toUser)
+	if err != nil { return }
+
+	s.mu.Lock(); width, bell := uc.width, uc.bell; s.mu.Unlock()
+
+	var ids []int64
+	for i, r := range rows {
+		if i == 0 && bell { uc.w.send(bel) } // once for the whole batch
+		s.printMissed(uc.w, toUser, r, width)
+		ids = append(ids, r.id)
+	}
+	s.mu.Lock(); uc.missed = ids; s.mu.Unlock()
+	if len(ids) > 0 {
+		systemLine(uc.w, fmt.Sprintf("You had %d offline message(s).", len(ids)))
+		// mark delivered
+		s.setDelivered(ids)
+	}
+}
+
+type missedRow struct{ id int64; sender, text, full, kind string; action, ack bool; sig sql.NullString; replyTo, thread sql.NullInt64 }
+
+// missedRows loads messages matching where, oldest first, as the offline flush
+// shows them; ack is set for /ack-request messages still awaiting an /ack.
+func (s *chatServer) missedRows(where string, args ...any) ([]missedRow, error) {
+	rows, err := s.db.Query(`
+SELECT id, sender, text, is_action, kind, strftime('%Y-%m-%d %H:%M:%S', ts), sig, ack_required AND acked_at IS NULL, reply_to, thread_id
+FROM messages WHERE `+where+` ORDER BY ts ASC`, args...)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var out []missedRow
+	for rows.Next() {
+		var r missedRow
+		_ = rows.Scan(&r.id, &r.sender, &r.text, &r.action, &r.kind, &r.full, &r.sig, &r.ack, &r.replyTo, &r.thread)
+		out = append(out, r)
+	}
+	return out, rows.Err()
+}
+
+func (s *chatServer) printMissed(w *outbox, toUser string, r missedRow, width int) {
+	mark := s.integrityMark(r.sender, toUser, r.text, r.full, r.kind, r.action, r.sig)
+	lines := wrapMessage(mark+mentionMark(r.text, toUser)+w.header("missed "+s.dbStamp(toUser, r.full), r.sender, r.action), r.text, width)
+	for _, l := range withQuote(s.threadLabel(r.thread.Int64), withQuote(s.quote(r.replyTo.Int64), lines)) {
+		writeLine(w, s.userColor(r.sender), l)
+	}
+	if r.ack { systemLine(w, ackPrompt(r.id)) }
+}
+
+// replayMissed is /missed: the offline flush from this login again, read back
+// by id so it doesn't touch delivered state. Messages deleted since are skipped.
+func (s *chatServer) replayMissed(w *outbox, username string) {
+	uc := s.session(username, w)
+	if uc == nil { return }
+	s.mu.Lock(); ids, width := uc.missed, uc.width; s.mu.Unlock()
+	if len(ids) == 0 { systemLine(w, "You didn't miss anything while you were offline."); return }
+	args := []any{username}
+	for _, id := range ids { args = append(args, id) }
+	rows, err := s.missedRows(`recipient=? AND id IN (?`+strings.Repeat(",?", len(ids)-1)+`)`, args...)
+	if err != nil { errorLine(w, "Could not load your missed messages."); return }
+	for _, r := range rows { s.printMissed(w, username, r, width) }
+	systemLine(w, fmt.Sprintf("%d message(s) you missed before this login.", len(rows)))
+}
+
+// ===== Read marks =====
+// read_marks holds one high-water message id per user: /mark sets it to the
+// newest message they've seen, and live deliveries push it forward. It is
+// separate from per-message delivered state and read receipts.
+
+// setMark is /mark: the newest message username sent or has been delivered.
+func (s *chatServer) setMark(w *outbox, username string) error {
+	s.flushDelivered() // count live deliveries still waiting to be marked
+	var id int64
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM messages
+WHERE kind!=? AND (sender=? OR (recipient=? AND delivered=1))`, kindSystem, username, username).Scan(&id); err != nil {
+		return errors.New("Could not read your position.")
+	}
+	if _, err := s.execRetry(`INSERT INTO read_marks(user, msg_id) VALUES(?, ?)
+ON CONFLICT(user) DO UPDATE SET msg_id=excluded.msg_id, marked_at=CURRENT_TIMESTAMP`, username, id); err != nil {
+		return errors.New("Could not save your mark.")
+	}
+	if id == 0 { systemLine(w, "Marked: nothing to read yet.") } else { systemLine(w, fmt.Sprintf("Marked: read up to #%d.", id)) }
+	return nil
+}
+
+// advanceMarks moves existing marks up to the newest of ids each user was
+// delivered, once the batch is marked delivered; users who never ran /mark
+// aren't tracked. args are ids as setDelivered binds them.
+func (s *chatServer) advanceMarks(placeholders string, args []any) {
+	if _, err := s.execRetry(`UPDATE read_marks SET msg_id=m.newest, marked_at=CURRENT_TIMESTAMP
+FROM (SELECT recipient, MAX(id) AS newest FROM messages WHERE id IN (`+placeholders+`) GROUP BY recipient) AS m
+WHERE read_marks.user=m.recipient AND read_marks.msg_id<m.newest`, args...); err != nil {
+		log.Printf("Advancing read marks: %v\n", err)
+	}
+}
+
+// unread reports how many messages reached username after their mark. At
+// login (explicit false) it stays quiet for users without a mark.
+func (s *chatServer) unread(w *outbox, username string, explicit bool) error {
+	s.flushDelivered() // so the mark includes live deliveries still waiting
+	var mark int64
+	var at string
+	err := s.db.QueryRow(`SELECT msg_id, strftime('%Y-%m-%d %H:%M:%S', marked_at) FROM read_marks WHERE user=?`, username).Scan(&mark, &at)
+	if errors.Is(err, sql.ErrNoRows) {
+		if explicit { systemLine(w, "No mark set yet. /mark records where you've read up to.") }
+		return nil
+	}
+	if err != nil { return errors.New("Could not read your mark.") }
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE recipient=? AND kind!=? AND id>?`, username, kindSystem, mark).Scan(&n); err != nil {
+		return errors.New("Could not count unread messages.")
+	}
+	if explicit {
+		systemLine(w, fmt.Sprintf("%d new since your last mark (#%d, %s).", n, mark, s.dbStamp(username, at)))
+	} else {
+		systemLine(w, fmt.Sprintf("%d new since your last mark.", n))
+	}
+	return nil
+}
+
+// ===== Delivered markers =====
+// Live deliveries are marked delivered=1 in batches: ids collect for up to
+// -delivered-window (or until -delivered-batch of them are waiting) and go out
+// in one UPDATE. The batch is flushed on SIGINT/SIGTERM; after a crash the
+// unflushed messages are only shown again as "missed" at the next login.
+
+// setDelivered marks ids delivered in one statement. If that fails they go
+// back on s.delivered for the next flush, so they aren't shown again as missed.
+// Read marks follow in one more statement per batch.
+func (s *chatServer) setDelivered(ids []int64) {
+	placeholders := strings.TrimRight(strings.Repeat("?,", len(ids)), ",")
+	args := make([]any, len(ids))
+	for i, id := range ids { args[i] = id }
+	if _, err := s.execRetry(`UPDATE messages SET delivered=1 WHERE id IN (`+placeholders+`)`, args...); err != nil {
+		log.Printf("Marking %d message(s) delivered: %v; will retry\n", len(ids), err)
+		s.deliveredMu.Lock(); s.delivered = append(s.delivered, ids...); s.deliveredMu.Unlock()
+		return
+	}
+	s.advanceMarks(placeholders, args)
+}
+
+func (s *chatServer) markDelivered(id int64) {
+	s.deliveredMu.Lock()
+	s.delivered = append(s.delivered, id)
+	full := s.opts.deliveredWindow <= 0 || len(s.delivered) >= s.opts.deliveredBatch
+	s.deliveredMu.Unlock()
+	if full { s.flushDelivered() }
+}
+
+func (s *chatServer) flushDelivered() {
+	s.deliveredMu.Lock()
+	ids := s.delivered
+	s.delivered = nil
+	s.deliveredMu.Unlock()
+	if len(ids) > 0 { s.setDelivered(ids) }
+}
+
+func (s *chatServer) flushDeliveredEvery(d time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(d)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop: return
+		case <-t.C: s.flushDelivered()
+		}
+	}
+}
+
+// shutdownOnSignal flushes pending delivered markers and closes the database
+// before exiting on SIGINT or SIGTERM.
+func (s *chatServer) shutdownOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	log.Printf("Shutting down on %v\n", <-sig)
+	s.flushDelivered()
+	_ = s.db.Close()
+	os.Exit(0)
+}
+
+type historyRow struct{ id int64; sdr, rcp, txt, full, kind string; action, pinned bool; sig sql.NullString; ack sql.NullString; replyTo, thread sql.NullInt64 }
+
+// historyRows loads the last n messages between the two users, oldest first.
+func (s *chatServer) historyRows(n int, chatOnly bool) []historyRow {
+	kindFilter := ""
+	if chatOnly { kindFilter = ` AND kind='` + kindChat + `'` }
+	stack := s.queryHistory(kindFilter+` ORDER BY ts DESC, id DESC LIMIT ?`, n)
+	reverseRows(stack)
+	return stack
+}
+
+// historySelect reads historyRow columns from the two users' conversation;
+// callers append further conditions and the ordering.
+const historySelect = `
+SELECT id, sender, recipient, text, is_action, kind, strftime('%Y-%m-%d %H:%M:%S', ts), sig, pinned,
+  CASE WHEN ack_required=0 THEN NULL ELSE COALESCE(strftime('%Y-%m-%d %H:%M:%S', acked_at), '') END, reply_to, thread_id
+FROM messages
+WHERE sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')`
+
+// queryHistory runs historySelect with tail appended; nil on error.
+func (s *chatServer) queryHistory(tail string, args ...any) []historyRow {
+	rows, err := s.db.Query(historySelect+tail, args...)
+	if err != nil { return nil }
+	defer rows.Close()
+	var out []historyRow
+	for rows.Next() {
+		var r historyRow
+		_ = rows.Scan(&r.id, &r.sdr, &r.rcp, &r.txt, &r.action, &r.kind, &r.full, &r.sig, &r.pinned, &r.ack, &r.replyTo, &r.thread)
+		out = append(out, r)
+	}
+	return out
+}
+
+func reverseRows(rs []historyRow) {
+	for i, j := 0, len(rs)-1; i < j; i, j = i+1, j-1 { rs[i], rs[j] = rs[j], rs[i] }
+}
+
+// contextRows loads up to n messages either side of id plus id itself, oldest
+// first. found is false when id isn't in the conversation.
+func (s *chatServer) contextRows(id int64, n int) (rows []historyRow, found bool) {
+	hit := s.queryHistory(` AND id=?`, id)
+	if len(hit) == 0 { return nil, false }
+	rows = s.queryHistory(` AND id<? ORDER BY id DESC LIMIT ?`, id, n)
+	reverseRows(rows)
+	rows = append(rows, hit[0])
+	return append(rows, s.queryHistory(` AND id>? ORDER BY id LIMIT ?`, id, n)...), true
+}
+
+// printHistory shows the last n messages; chatOnly restricts it to kind='chat',
+// hiding actions and system notices.
+func (s *chatServer) printHistory(w *outbox, username string, n int, chatOnly bool) {
+	s.printRows(w, username, s.historyRows(n, chatOnly), 0)
+}
+
+// printRows renders history rows; the row whose id is hit (if any) is drawn
+// bold with a "▶" marker.
+func (s *chatServer) printRows(w *outbox, username string, rows []historyRow, hit int64) {
+	width := s.widthOf(username)
+	for _, r := range rows {
+		mark := s.integrityMark(r.sdr, r.rcp, r.txt, r.full, r.kind, r.action, r.sig)
+		pin := ""
+		if r.pinned { pin = "📌 " }
+		switch {
+		case !r.ack.Valid:
+		case r.ack.String == "": mark += "[awaiting ack] "
+		default: mark += "[acked " + s.dbStamp(username, r.ack.String) + "] "
+		}
+		prefix := fmt.Sprintf("#%d %s%s%s", r.id, pin, mark, w.header(s.dbStamp(username, r.full), r.sdr, r.action))
+		for _, l := range withQuote(s.threadLabel(r.thread.Int64), withQuote(s.quote(r.replyTo.Int64), wrapMessage(prefix, r.txt, width))) {
+			if r.id == hit { l = "\x1b[1m▶ " + l + "\x1b[22m" }
+			writeLine(w, s.userColor(r.sdr), l)
+		}
+	}
+}
+
+// defaultContext and maxContext bound /context's N.
+const (
+	defaultContext = 5
+	maxContext     = 50
+)
+
+// digestEnds is how many messages /digest shows from each end of the day.
+const digestEnds = 3
+
+// digest is /digest: per-sender counts and first/last times for one UTC day
+// (YYYY-MM-DD), then the first and last digestEnds messages of that day.
+func (s *chatServer) digest(w *outbox, username, day string) error {
+	rows, err := s.db.Query(`
+SELECT sender, COUNT(*), strftime('%Y-%m-%d %H:%M:%S', MIN(ts)), strftime('%Y-%m-%d %H:%M:%S', MAX(ts))
+FROM messages
+WHERE sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib') AND date(ts) = date(?)
+GROUP BY sender ORDER BY COUNT(*) DESC, sender`, day)
+	if err != nil { return errors.New("Digest unavailable.") }
+	defer rows.Close()
+	var lines []string
+	total := 0
+	for rows.Next() {
+		var sender, first, last string
+		var n int
+		if rows.Scan(&sender, &n, &first, &last) != nil { continue }
+		total += n
+		lines = append(lines, fmt.Sprintf("  %-10s %4d  %s – %s", sender, n, s.dbStamp(username, first), s.dbStamp(username, last)))
+	}
+	if total == 0 { systemLine(w, "No messages on "+day+"."); return nil }
+	systemLine(w, fmt.Sprintf("Digest for %s: %d message(s).", day, total))
+	for _, l := range lines { systemLine(w, l) }
+	if total <= 2*digestEnds {
+		s.printRows(w, username, s.queryHistory(` AND date(ts) = date(?) ORDER BY ts, id`, day), 0)
+		return nil
+	}
+	systemLine(w, "First:")
+	s.printRows(w, username, s.queryHistory(` AND date(ts) = date(?) ORDER BY ts, id LIMIT ?`, day, digestEnds), 0)
+	systemLine(w, fmt.Sprintf("… %d more …", total-2*digestEnds))
+	last := s.queryHistory(` AND date(ts) = date(?) ORDER BY ts DESC, id DESC LIMIT ?`, day, digestEnds)
+	reverseRows(last)
+	systemLine(w, "Last:")
+	s.printRows(w, username, last, 0)
+	return nil
+}
+
+// replayAll is /replayall [N]: the last n messages redrawn the way they first
+// appeared to username, i.e. the live delivery rendering (no ids or pins) for
+// the peer's messages and the /echo rendering for their own.
+func (s *chatServer) replayAll(w *outbox, username string, n int) {
+	width := s.widthOf(username)
+	for _, r := range s.historyRows(n, false) {
+		ts := s.dbStamp(username, r.full)
+		color := s.userColor(r.sdr)
+		lines := liveLines(w, r.sdr, username, r.txt, ts, r.action, width)
+		if r.sdr == username { color, lines = gray, wrapMessage(w.header(ts, r.sdr, r.action), r.txt, width) }
+		for _, l := range withQuote(s.threadLabel(r.thread.Int64), withQuote(s.quote(r.replyTo.Int64), lines)) { writeLine(w, color, l) }
+	}
+}
+
+// printHistoryJSON is /history json: the same messages as one uncolored JSON
+// array on a single line, for clients that render their own UI. ts is UTC RFC 3339.
+func (s *chatServer) printHistoryJSON(w *outbox, n int, chatOnly bool) {
+	type item struct {
+		ID       int64  `json:"id"`
+		Sender   string `json:"sender"`
+		Text     string `json:"text"`
+		TS       string `json:"ts"`
+		ReplyTo  int64  `json:"reply_to,omitempty"`
+		ThreadID int64  `json:"thread_id,omitempty"`
+	}
+	items := []item{}
+	for _, r := range s.historyRows(n, chatOnly) {
+		ts := r.full
+		if t, err := time.Parse(dbTimeLayout, r.full); err == nil { ts = t.UTC().Format(time.RFC3339) }
+		items = append(items, item{r.id, r.sdr, r.txt, ts, r.replyTo.Int64, r.thread.Int64})
+	}
+	b, err := json.Marshal(items)
+	if err != nil { errorLine(w, "Could not encode history."); return }
+	w.send(string(b) + "\r\n")
+}
+
+// printEdits is /history edits <id>: every earlier version of a message, oldest
+// first, from message_edits. Only the sender and recipient may see them.
+// Nothing writes message_edits yet; it's kept for an /edit command, so for now
+// every message reports no edits.
+func (s *chatServer) printEdits(w *outbox, username string, args []string) {
+	id, ok := parseMessageID(args)
+	if !ok { errorLine(w, "Usage: /history edits <message id>"); return }
+	var sdr, rcp, text string
+	err := s.db.QueryRow(`SELECT sender, recipient, text FROM messages WHERE id=?`, id).Scan(&sdr, &rcp, &text)
+	if err != nil || (username != sdr && username != rcp) {
+		errorLine(w, fmt.Sprintf("No message #%d.", id))
+		return
+	}
+	rows, err := s.db.Query(`SELECT old_text, strftime('%Y-%m-%d %H:%M:%S', edited_at) FROM message_edits WHERE message_id=? ORDER BY edited_at, rowid`, id)
+	if err != nil { errorLine(w, "Could not load edits."); return }
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var old, at string
+		if err := rows.Scan(&old, &at); err != nil { errorLine(w, "Could not load edits."); return }
+		lines = append(lines, fmt.Sprintf("v%d (replaced %s): %s", len(lines)+1, s.dbStamp(username, at), old))
+	}
+	if rows.Err() != nil { errorLine(w, "Could not load edits."); return }
+	if len(lines) == 0 { systemLine(w, fmt.Sprintf("Message #%d has not been edited.", id)); return }
+	for _, l := range lines { writeLine(w, s.userColor(sdr), l) }
+	writeLine(w, s.userColor(sdr), fmt.Sprintf("current: %s", text))
+}
+
+// ===== Login logging =====
+// Every login is logged with the client's reverse-DNS name and, with -geoip-db,
+// a country code. login_ips remembers which addresses each user has come from,
+// and a login from one not seen before (for a user who has logged in before) is
+// logged as a WARN. This runs off the handler goroutine since rDNS can be slow.
+// Separately, every attempt, failed or not, goes to login_audit for /logins;
+// it keeps the last -login-audit-keep, so a password-guessing run can't grow
+// it without bound.
+
+func (s *chatServer) auditLogin(username string, addr net.Addr, success bool) {
+	res, err := s.execRetry(`INSERT INTO login_audit(username, remote_addr, success) VALUES(?,?,?)`, username, addr.String(), success)
+	if err != nil {
+		log.Printf("login_audit: %v\n", err)
+		return
+	}
+	if s.opts.auditKeep <= 0 { return }
+	// each user's last success stays for /whois, however many failures followed
+	id, _ := res.LastInsertId()
+	if _, err := s.execRetry(`DELETE FROM login_audit WHERE rowid <= ?
+AND rowid NOT IN (SELECT MAX(rowid) FROM login_audit WHERE success=1 GROUP BY username)`, id-int64(s.opts.auditKeep)); err != nil {
+		log.Printf("login_audit prune: %v\n", err)
+	}
+}
+
+// handleLogins is /logins [N] (admin): the last N login attempts, oldest first.
+func (s *chatServer) handleLogins(w *outbox, username string, args []string) {
+	if username != s.opts.admin {
+		errorLine(w, "Only the admin can review logins.")
+		return
+	}
+	n := 20
+	if len(args) == 1 {
+		v, err := strconv.Atoi(args[0])
+		if err != nil || v <= 0 || v > 500 { errorLine(w, "Usage: /logins [N]  (1-500)"); return }
+		n = v
+	}
+	rows, err := s.db.Query(`SELECT username, remote_addr, strftime('%Y-%m-%d %H:%M:%S', ts), success FROM
+(SELECT rowid, * FROM login_audit ORDER BY rowid DESC LIMIT ?) ORDER BY rowid`, n)
+	if err != nil { errorLine(w, "Could not load login attempts."); return }
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var u, addr, ts string
+		var ok bool
+		if rows.Scan(&u, &addr, &ts, &ok) != nil { continue }
+		result := "FAILED"
+		if ok { result = "ok" }
+		systemLine(w, fmt.Sprintf("[%s] %-6s %s from %s", s.dbStamp(username, ts), result, u, addr))
+		count++
+	}
+	if count == 0 { systemLine(w, "No login attempts recorded.") }
+}
+
+const rdnsTimeout = 2 * time.Second
+
+// hostOf is the host part of a "host:port" address, or addr itself.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil { return addr }
+	return host
+}
+
+// ===== PROXY protocol =====
+// Behind a TCP load balancer every connection comes from the balancer. With
+// -proxy-protocol, connections from -proxy-from sources must open with a PROXY
+// protocol header (v1 text or v2 binary) naming the real client, and the conn
+// reports that client as its RemoteAddr, so bans, the login audit and every
+// log line see it. Other sources still connect directly. The WebSocket
+// listener gets the same from X-Forwarded-For.
+
+const (
+	proxyHeaderTimeout = 5 * time.Second
+	proxyV1Max         = 107 // longest v1 line, CRLF included
+	proxyV2Sig         = "\r\n\r\n\x00\r\nQUIT\n"
+)
+
+// proxyConn is a conn whose PROXY header has been consumed: reads continue
+// from r, which may already hold the client's first bytes.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+func (c *proxyConn) RemoteAddr() net.Addr        { return c.remote }
+
+func (s *chatServer) fromProxy(addr net.Addr) bool {
+	ip := net.ParseIP(hostOf(addr.String()))
+	if ip == nil { return false }
+	for _, n := range s.opts.proxyFrom {
+		if n.Contains(ip) { return true }
+	}
+	return false
+}
+
+// readProxyHeader reads the header c must start with. A LOCAL or UNKNOWN
+// header (the proxy's own health check) keeps the proxy's address.
+func readProxyHeader(c net.Conn) (net.Conn, error) {
+	_ = c.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+	defer c.SetReadDeadline(time.Time{})
+	br := bufio.NewReader(c)
+	remote, err := parseProxyHeader(br)
+	if err != nil { return nil, err }
+	if remote == nil { remote = c.RemoteAddr() }
+	return &proxyConn{Conn: c, r: br, remote: remote}, nil
+}
+
+func parseProxyHeader(br *bufio.Reader) (net.Addr, error) {
+	sig, err := br.Peek(len(proxyV2Sig))
+	if err != nil { return nil, err }
+	if string(sig) == proxyV2Sig { return parseProxyV2(br) }
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > proxyV1Max || !strings.HasPrefix(string(line), "PROXY ") || !strings.HasSuffix(string(line), "\r\n") {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" { return nil, nil }
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") { return nil, fmt.Errorf("bad PROXY header %q", strings.TrimSpace(string(line))) }
+	ip := net.ParseIP(f[2])
+	port, err := strconv.ParseUint(f[4], 10, 16)
+	if ip == nil || err != nil { return nil, fmt.Errorf("bad PROXY header %q", strings.TrimSpace(string(line))) }
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// parseProxyV2 reads a binary header: signature, version/command, family,
+// length, then the address block (and any TLVs, which are skipped).
+func parseProxyV2(br *bufio.Reader) (net.Addr, error) {
+	var hdr [16]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil { return nil, err }
+	if hdr[12]>>4 != 2 { return nil, fmt.Errorf("unsupported PROXY protocol version %d", hdr[12]>>4) }
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(br, body); err != nil { return nil, err }
+	switch hdr[12] & 0xF {
+	case 0: return nil, nil // LOCAL
+	case 1:
+	default: return nil, fmt.Errorf("bad PROXY v2 command %d", hdr[12]&0xF)
+	}
+	switch hdr[13] >> 4 {
+	case 1: // IPv4: src, dst, src port, dst port
+		if len(body) >= 12 { return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil }
+	case 2: // IPv6
+		if len(body) >= 36 { return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil }
+	default: return nil, nil // AF_UNSPEC or a unix socket: nothing useful
+	}
+	return nil, errors.New("short PROXY v2 address block")
+}
+
+// wsClient is the WebSocket client's address: r.RemoteAddr, or, when that is
+// a -proxy-from proxy, the rightmost X-Forwarded-For hop that isn't one (the
+// leftmost if every hop is trusted). Forwarded hops carry no port.
+func (s *chatServer) wsClient(r *http.Request) net.Addr {
+	var addr net.Addr = &net.TCPAddr{IP: net.ParseIP(hostOf(r.RemoteAddr))}
+	if ap, err := netip.ParseAddrPort(r.RemoteAddr); err == nil { addr = net.TCPAddrFromAddrPort(ap) }
+	if !s.fromProxy(addr) { return addr }
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil { break }
+		addr = &net.TCPAddr{IP: ip}
+		if !s.fromProxy(addr) { break }
+	}
+	return addr
+}
+
+// ===== IP bans =====
+// /ban-ip stores an address or CIDR range in banned_ips; accept closes
+// connections from a banned address (the real client, with -proxy-protocol)
+// before handle sends anything. The list is cached in s.bans and reloaded on each change.
+
+func loadBans(db *sql.DB) ([]*net.IPNet, error) {
+	rows, err := db.Query(`SELECT cidr FROM banned_ips`)
+	if err != nil { return nil, err }
+	defer rows.Close()
+	var bans []*net.IPNet
+	for rows.Next() {
+		var c string
+		if err := rows.Scan(&c); err != nil { return nil, err }
+		if _, n, err := net.ParseCIDR(c); err == nil { bans = append(bans, n) }
+	}
+	return bans, rows.Err()
+}
+
+// parseBan reads an address or CIDR range; a bare address is a range of one.
+func parseBan(arg string) (*net.IPNet, error) {
+	if !strings.Contains(arg, "/") {
+		ip := net.ParseIP(arg)
+		if ip == nil { return nil, fmt.Errorf("Not an IP address or CIDR range: %s", arg) }
+		bits := 128
+		if ip4 := ip.To4(); ip4 != nil { ip, bits = ip4, 32 }
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, n, err := net.ParseCIDR(arg)
+	if err != nil { return nil, fmt.Errorf("Not an IP address or CIDR range: %s", arg) }
+	return n, nil
+}
+
+func (s *chatServer) bannedIP(ip net.IP) bool {
+	s.banMu.Lock(); defer s.banMu.Unlock()
+	for _, n := range s.bans {
+		if n.Contains(ip) { return true }
+	}
+	return false
+}
+
+func (s *chatServer) isBanned(addr net.Addr) bool {
+	ip := net.ParseIP(hostOf(addr.String()))
+	if ip == nil || !s.bannedIP(ip) { return false }
+	log.Printf("Refused connection from banned %s\n", addr)
+	return true
+}
+
+// handleBanIP is /ban-ip and /unban-ip (ban false).
+func (s *chatServer) handleBanIP(w *outbox, username string, args []string, ban bool) error {
+	if username != s.opts.admin { return errors.New("Only the admin can manage IP bans.") }
+	if ban && len(args) == 0 {
+		s.banMu.Lock(); bans := append([]*net.IPNet(nil), s.bans...); s.banMu.Unlock()
+		if len(bans) == 0 { systemLine(w, "No IP bans.") }
+		for _, n := range bans { systemLine(w, "  "+n.String()) }
+		return nil
+	}
+	if len(args) != 1 {
+		if ban { return errors.New("Usage: /ban-ip [<addr>|<cidr>]") }
+		return errors.New("Usage: /unban-ip <addr>|<cidr>")
+	}
+	n, err := parseBan(args[0])
+	if err != nil { return err }
+	if ban {
+		_, err = s.execRetry(`INSERT OR IGNORE INTO banned_ips(cidr, banned_by) VALUES(?, ?)`, n.String(), username)
+	} else {
+		var res sql.Result
+		if res, err = s.execRetry(`DELETE FROM banned_ips WHERE cidr=?`, n.String()); err == nil {
+			if k, _ := res.RowsAffected(); k == 0 { return errors.New("No ban on " + n.String() + ".") }
+		}
+	}
+	if err != nil { return errors.New("Could not update IP bans.") }
+	bans, err := loadBans(s.db)
+	if err != nil { return errors.New("Could not reload IP bans.") }
+	s.banMu.Lock(); s.bans = bans; s.banMu.Unlock()
+	if !ban {
+		log.Printf("%s unbanned %s\n", username, n)
+		systemLine(w, "Unbanned "+n.String()+".")
+		return nil
+	}
+	log.Printf("%s banned %s\n", username, n)
+	systemLine(w, "Banned "+n.String()+".")
+	// every connection from the range goes, including ones still at the login prompt
+	s.mu.Lock()
+	var open []*outbox
+	for ow, c := range s.conns {
+		if ip := net.ParseIP(hostOf(c.RemoteAddr().String())); ip != nil && n.Contains(ip) && ow != w { open = append(open, ow) }
+	}
+	s.mu.Unlock()
+	for _, ow := range open { ow.close() }
+	if len(open) > 0 { systemLine(w, fmt.Sprintf("Closed %d connection(s) from there.", len(open))) }
+	return nil
+}
+
+func (s *chatServer) logLogin(username string, addr net.Addr) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil { host = addr.String() }
+
+	ctx, cancel := context.WithTimeout(context.Background(), rdnsTimeout)
+	defer cancel()
+	where := host
+	if names, err := net.DefaultResolver.LookupAddr(ctx, host); err == nil && len(names) > 0 {
+		where += " (" + strings.TrimSuffix(names[0], ".") + ")"
+	}
+	if cc := s.country(host); cc != "" { where += " [" + cc + "]" }
+
+	var known, seen int
+	_ = s.db.QueryRow(`SELECT COUNT(*), COALESCE(SUM(ip=?), 0) FROM login_ips WHERE username=?`, host, username).Scan(&known, &seen)
+	_, err = s.db.Exec(`INSERT INTO login_ips(username, ip) VALUES(?,?)
+ON CONFLICT(username, ip) DO UPDATE SET last_seen=CURRENT_TIMESTAMP`, username, host)
+	if err != nil { log.Printf("login_ips: %v\n", err) }
+
+	if known > 0 && seen == 0 {
+		log.Printf("WARN: %s logged in from a new address %s\n", username, where)
+		return
+	}
+	log.Printf("%s logged in from %s\n", username, where)
+}
+
+type geoRange struct {
+	start, end netip.Addr
+	country    string
+}
+
+// loadGeoIP reads a country CSV such as DB-IP's free "IP to Country Lite":
+// start_ip,end_ip,country per row. An empty path disables lookups.
+func loadGeoIP(path string) ([]geoRange, error) {
+	if path == "" { return nil, nil }
+	f, err := os.Open(path)
+	if err != nil { return nil, fmt.Errorf("geoip db: %w", err) }
+	defer f.Close()
+	cr := csv.NewReader(f)
+	cr.FieldsPerRecord = -1
+	var out []geoRange
+	for line := 1; ; line++ {
+		rec, err := cr.Read()
+		if errors.Is(err, io.EOF) { break }
+		if err != nil { return nil, fmt.Errorf("geoip db: %w", err) }
+		if len(rec) < 3 { return nil, fmt.Errorf("geoip db line %d: want start_ip,end_ip,country", line) }
+		start, err1 := netip.ParseAddr(strings.TrimSpace(rec[0]))
+		end, err2 := netip.ParseAddr(strings.TrimSpace(rec[1]))
+		if err1 != nil || err2 != nil {
+			if line == 1 { continue } // header row
+			return nil, fmt.Errorf("geoip db line %d: bad address", line)
+		}
+		out = append(out, geoRange{start.Unmap(), end.Unmap(), strings.TrimSpace(rec[2])})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].start.Less(out[j].start) })
+	log.Printf("Loaded %d GeoIP ranges from %s\n", len(out), path)
+	return out, nil
+}
+
+// country returns the country code for ip, or "" if unknown or lookups are off.
+func (s *chatServer) country(ip string) string {
+	a, err := netip.ParseAddr(ip)
+	if err != nil || s.geo == nil { return "" }
+	a = a.Unmap()
+	// last range starting at or before a
+	i := sort.Search(len(s.geo), func(i int) bool { return a.Less(s.geo[i].start) }) - 1
+	if i < 0 || s.geo[i].end.Less(a) || s.geo[i].start.BitLen() != a.BitLen() { return "" }
+	return s.geo[i].country
+}
+
+// ===== Backups =====
+// /backup uses VACUUM INTO rather than copying chat.db: a file copy can catch
+// the database mid-transaction or miss pages still in the WAL.
+
+func (s *chatServer) handleBackup(w *outbox, username string, args []string) {
+	if username != s.opts.admin {
+		errorLine(w, "Only the admin can back up the database.")
+		return
+	}
+	if len(args) != 1 { errorLine(w, "Usage: /backup <file>"); return }
+	if !filepath.IsLocal(args[0]) {
+		errorLine(w, "The backup file must be a relative path inside the backup directory, without ..")
+		return
+	}
+	dst := filepath.Join(s.opts.backupDir, args[0])
+	if sameFile(dst, dbFile) || sameFile(dst, dbFile+"-wal") || sameFile(dst, dbFile+"-shm") {
+		errorLine(w, "Refusing to overwrite the live database.")
+		return
+	}
+	if _, err := os.Lstat(dst); err == nil {
+		errorLine(w, dst+" already exists.")
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		log.Printf("backup: %v\n", err)
+		errorLine(w, "Could not create the backup directory.")
+		return
+	}
+	start := time.Now()
+	if _, err := s.db.Exec(`VACUUM INTO ?`, dst); err != nil {
+		log.Printf("backup %s: %v\n", dst, err)
+		errorLine(w, "Backup failed.")
+		return
+	}
+	fi, err := os.Stat(dst)
+	if err != nil { errorLine(w, "Backup written but could not be read back."); return }
+	abs, _ := filepath.Abs(dst)
+	log.Printf("%s backed up the database to %s (%d bytes)\n", username, abs, fi.Size())
+	systemLine(w, fmt.Sprintf("Backed up to %s (%d bytes, %s).", abs, fi.Size(), time.Since(start).Round(time.Millisecond)))
+}
+
+// ===== Export =====
+// /export writes the conversation under -export-dir. With -export-key the file
+// is an ASCII-armored PGP message only the key holder can read, so exported
+// archives aren't plaintext at rest.
+
+// loadExportKey reads the armored public key(s) /export encrypts to. An empty
+// path leaves exports in plaintext.
+func loadExportKey(path string) (openpgp.EntityList, error) {
+	if path == "" { return nil, nil }
+	f, err := os.Open(path)
+	if err != nil { return nil, fmt.Errorf("export key: %w", err) }
+	defer f.Close()
+	keys, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil { return nil, fmt.Errorf("export key %s: %w", path, err) }
+	for _, k := range keys {
+		if k.PrivateKey != nil { return nil, fmt.Errorf("export key %s: contains a private key; give only the public key", path) }
+	}
+	log.Printf("Encrypting /export transcripts to %d PGP key(s) from %s\n", len(keys), path)
+	return keys, nil
+}
+
+func (s *chatServer) handleExport(w *outbox, username string, args []string) {
+	if username != s.opts.admin {
+		errorLine(w, "Only the admin can export the conversation.")
+		return
+	}
+	if len(args) != 1 { errorLine(w, "Usage: /export <file>"); return }
+	if !filepath.IsLocal(args[0]) {
+		errorLine(w, "The export file must be a relative path inside the export directory, without ..")
+		return
+	}
+	name := args[0]
+	if s.exportTo != nil && !strings.HasSuffix(name, ".asc") { name += ".asc" }
+	dst := filepath.Join(s.opts.exportDir, name)
+	if sameFile(dst, dbFile) || sameFile(dst, dbFile+"-wal") || sameFile(dst, dbFile+"-shm") {
+		errorLine(w, "Refusing to overwrite the live database.")
+		return
+	}
+	rows := s.queryHistory(` AND kind IN ('`+kindChat+`','`+kindAction+`') ORDER BY ts, id`)
+	if err := os.MkdirAll(filepath.Dir(dst), 0o700); err != nil {
+		log.Printf("export: %v\n", err)
+		errorLine(w, "Could not create the export directory.")
+		return
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if errors.Is(err, os.ErrExist) { errorLine(w, dst+" already exists."); return }
+	if err != nil {
+		log.Printf("export %s: %v\n", dst, err)
+		errorLine(w, "Could not create the export file.")
+		return
+	}
+	err = s.writeTranscript(f, rows, filepath.Base(name))
+	if cerr := f.Close(); err == nil { err = cerr }
+	if err != nil {
+		log.Printf("export %s: %v\n", dst, err)
+		os.Remove(dst)
+		errorLine(w, "Export failed.")
+		return
+	}
+	abs, _ := filepath.Abs(dst)
+	how := "plain text"
+	if s.exportTo != nil { how = "PGP-encrypted" }
+	log.Printf("%s exported %d messages to %s (%s)\n", username, len(rows), abs, how)
+	systemLine(w, fmt.Sprintf("Exported %d messages to %s (%s).", len(rows), abs, how))
+}
+
+// writeTranscript writes rows as "[ts UTC] sender: text" lines to f, through
+// PGP encryption and armor when an export key is configured.
+func (s *chatServer) writeTranscript(f io.Writer, rows []historyRow, name string) error {
+	var out io.Writer = f
+	var closers []io.Closer
+	if s.exportTo != nil {
+		aw, err := armor.Encode(f, "PGP MESSAGE", nil)
+		if err != nil { return err }
+		pw, err := openpgp.Encrypt(aw, s.exportTo, nil, &openpgp.FileHints{FileName: strings.TrimSuffix(name, ".asc"), ModTime: time.Now()}, nil)
+		if err != nil { return err }
+		out, closers = pw, []io.Closer{pw, aw}
+	}
+	bw := bufio.NewWriter(out)
+	for _, r := range rows {
+		if r.action { fmt.Fprintf(bw, "[%s UTC] * %s %s\n", r.full, r.sdr, r.txt) } else { fmt.Fprintf(bw, "[%s UTC] %s: %s\n", r.full, r.sdr, r.txt) }
+	}
+	if err := bw.Flush(); err != nil { return err }
+	for _, c := range closers {
+		if err := c.Close(); err != nil { return err }
+	}
+	return nil
+}
+
+// sameFile reports whether a and b name the same file, comparing absolute
+// paths when either doesn't exist yet.
+func sameFile(a, b string) bool {
+	if fa, err := os.Stat(a); err == nil {
+		if fb, err := os.Stat(b); err == nil { return os.SameFile(fa, fb) }
+	}
+	aa, err1 := filepath.Abs(a)
+	ab, err2 := filepath.Abs(b)
+	return err1 == nil && err2 == nil && aa == ab
+}
+
+// ===== Summary =====
+// /summary [N] posts the last N messages to an OpenAI-compatible chat completions
+// endpoint: SUMMARY_API_URL (e.g. https://api.openai.com/v1/chat/completions),
+// SUMMARY_API_KEY and SUMMARY_MODEL. Run with -no-summary to disable it.
+
+const summaryTimeout = 30 * time.Second
+
+func (s *chatServer) handleSummary(w *outbox, n int) {
+	endpoint := os.Getenv("SUMMARY_API_URL")
+	if s.opts.noSummary || endpoint == "" {
+		systemLine(w, "Summary unavailable (disabled on this server).")
+		return
+	}
+	transcript, err := s.transcript(n)
+	if err != nil || transcript == "" {
+		systemLine(w, "Nothing to summarize.")
+		return
+	}
+	systemLine(w, fmt.Sprintf("Summarizing the last %d message(s)...", n))
+	summary, err := requestSummary(endpoint, os.Getenv("SUMMARY_API_KEY"), os.Getenv("SUMMARY_MODEL"), transcript)
+	if err != nil {
+		log.Printf("Summary request failed: %v\n", err)
+		systemLine(w, "Summary unavailable.")
+		return
+	}
+	for _, l := range strings.Split(strings.TrimSpace(summary), "\n") {
+		systemLine(w, l)
+	}
+}
+
+// transcript returns the last n messages as plain "sender: text" lines, oldest first.
+func (s *chatServer) transcript(n int) (string, error) {
+	rows, err := s.db.Query(`
+SELECT sender, text, is_action FROM messages
+WHERE sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')
+ORDER BY ts DESC, id DESC LIMIT ?`, n)
+	if err != nil { return "", err }
+	defer rows.Close()
+	var lines []string
+	for rows.Next() {
+		var sdr, txt string; var action bool
+		if err := rows.Scan(&sdr, &txt, &action); err != nil { return "", err }
+		if action { lines = append(lines, "* "+sdr+" "+txt) } else { lines = append(lines, sdr+": "+txt) }
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 { lines[i], lines[j] = lines[j], lines[i] }
+	return strings.Join(lines, "\n"), rows.Err()
+}
+
+func requestSummary(endpoint, key, model, transcript string) (string, error) {
+	if model == "" { model = "gpt-4o-mini" }
+	type message struct {
+		Role    string `json:"role"`
+		Content string `json:"content"`
+	}
+	body, _ := json.Marshal(map[string]any{
+		"model": model,
+		"messages": []message{
+			{Role: "system", Content: "Summarize this chat conversation in a few short bullet points."},
+			{Role: "user", Content: transcript},
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), summaryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(string(body)))
+	if err != nil { return "", err }
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" { req.Header.Set("Authorization", "Bearer "+key) }
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil { return "", err }
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK { return "", fmt.Errorf("status %s", resp.Status) }
+	var out struct {
+		Choices []struct {
+			Message message `json:"message"`
+		} `json:"choices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil { return "", err }
+	if len(out.Choices) == 0 { return "", errors.New("empty response") }
+	return out.Choices[0].Message.Content, nil
+}
+
+// handleSearch runs /search [from:<user>] [to:<user>] <text>. Without a prefix
+// both directions of the conversation are searched.
+func (s *chatServer) handleSearch(w *outbox, username string, args []string) {
+	var from, to string
+	var terms []string
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "from:"):
+			from = strings.TrimPrefix(a, "from:")
+		case strings.HasPrefix(a, "to:"):
+			to = strings.TrimPrefix(a, "to:")
+		default:
+			terms = append(terms, a)
+		}
+	}
+	q := strings.Join(terms, " ")
+	if q == "" {
+		errorLine(w, "Usage: /search [from:<user>] [to:<user>] <text>")
+		return
+	}
+	for _, u := range []string{from, to} {
+		if u != "" && u != bilalUser && u != zohaibUser {
+			errorLine(w, "Unknown user: "+u)
+			return
+		}
+	}
+
+	where := []string{`sender IN ('bilal','zohaib') AND recipient IN ('bilal','zohaib')`, `text LIKE ? ESCAPE '\'`}
+	esc := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(q)
+	qargs := []any{"%" + esc + "%"}
+	if from != "" { where = append(where, "sender=?"); qargs = append(qargs, from) }
+	if to != "" { where = append(where, "recipient=?"); qargs = append(qargs, to) }
+
+	rows, err := s.db.Query(`
+SELECT id, sender, text, strftime('%Y-%m-%d %H:%M:%S', ts), is_action
+FROM messages
+WHERE `+strings.Join(where, " AND ")+`
+ORDER BY ts DESC LIMIT 50`, qargs...)
+	if err != nil { systemLine(w, "Search failed."); return }
+	defer rows.Close()
+	type hit struct{ id int64; sdr, txt, hh string; action bool }
+	var hits []hit
+	for rows.Next() {
+		var h hit
+		_ = rows.Scan(&h.id, &h.sdr, &h.txt, &h.hh, &h.action)
+		hits = append(hits, h)
+	}
+	if len(hits) == 0 { systemLine(w, "No matches."); return }
+	for i := len(hits)-1; i >= 0; i-- {
+		h := hits[i]
+		writeLine(w, s.userColor(h.sdr), fmt.Sprintf("#%d %s", h.id, formatMessage(w, s.dbStamp(username, h.hh), h.sdr, h.txt, h.action)))
+	}
+	systemLine(w, fmt.Sprintf("%d match(es).", len(hits)))
 }
 
 // ===== Video flow =====
 // /video from requester → prompts callee to accept or decline. If accepted, generate sid and print URLs.
+// /video call does the same for a two-way call: both open call.html, the
+// requester as "caller" (who makes the WebRTC offer) and the callee as "callee".
 
-func (s *chatServer) handleVideoRequest(requester string) {
+// videoRequest is a pending /video, keyed in chatServer.videoReq by callee.
+type videoRequest struct {
+	from string
+	call bool // two-way call rather than viewing the callee's camera
+}
+
+func (s *chatServer) handleVideoRequest(w *outbox, requester string, call bool) {
 	callee := s.peerOf(requester)
-	s.mu.Lock(); calleeConn := s.clients[callee]; s.mu.Unlock()
-	if calleeConn == nil {
-		if reqConn := s.clients[requester]; reqConn != nil {
-			writeLine(reqConn.w, yellow, "Peer offline; cannot start video.")
-		}
+	var noVideo bool
+	_ = s.db.QueryRow(`SELECT no_video FROM users WHERE username=?`, callee).Scan(&noVideo)
+	if noVideo {
+		systemLine(w, callee+" is not accepting video calls")
+		return
+	}
+	if len(s.sessions(callee)) == 0 {
+		systemLine(w, "Peer offline; cannot start video.")
 		return
 	}
+	s.reconcileCalls(requester, callee)
+	s.mu.Lock(); full := s.videoFullLocked(requester, callee); s.mu.Unlock()
+	if full != "" { errorLine(w, s.videoFullMessage(requester, full)); return }
 	// record pending request
-	s.mu.Lock(); s.videoReq[callee] = requester; s.mu.Unlock()
-	writeLine(calleeConn.w, yellow, fmt.Sprintf("%s requests your camera. Type /acceptvideo or /declinevideo", requester))
+	s.videoMu.Lock(); s.videoReq[callee] = videoRequest{from: requester, call: call}; s.videoMu.Unlock()
+	if call {
+		s.notifyUser(callee, fmt.Sprintf("%s wants a video call. Type /acceptvideo or /declinevideo", requester))
+		return
+	}
+	s.notifyUser(callee, fmt.Sprintf("%s requests your camera. Type /acceptvideo or /declinevideo", requester))
+}
+
+// handleNoVideo is /novideo on|off: with it on, video requests to the user are
+// refused without prompting them (users.no_video).
+func (s *chatServer) handleNoVideo(w *outbox, username, arg string) {
+	var on bool
+	switch arg {
+	case "on": on = true
+	case "off":
+	case "":
+		_ = s.db.QueryRow(`SELECT no_video FROM users WHERE username=?`, username).Scan(&on)
+		state := "off"
+		if on { state = "on" }
+		systemLine(w, "No-video is "+state+". Usage: /novideo on|off")
+		return
+	default:
+		errorLine(w, "Usage: /novideo on|off")
+		return
+	}
+	if _, err := s.execRetry(`UPDATE users SET no_video=? WHERE username=?`, on, username); err != nil {
+		if errors.Is(err, errDBBusy) { errorLine(w, "Server busy, retry."); return }
+		errorLine(w, "Could not save your video preference.")
+		return
+	}
+	if on { systemLine(w, "Video requests to you will be refused.") } else { systemLine(w, "Video requests to you are allowed again.") }
 }
 
-func (s *chatServer) handleVideoAccept(callee string) {
-	s.mu.Lock(); requester, ok := s.videoReq[callee]; if ok { delete(s.videoReq, callee) }; s.mu.Unlock()
-	if !ok { if c := s.clients[callee]; c != nil { writeLine(c.w, yellow, "No pending video request.") }; return }
+func (s *chatServer) handleVideoAccept(w *outbox, callee string) {
+	s.videoMu.Lock(); req, ok := s.videoReq[callee]; if ok { delete(s.videoReq, callee) }; s.videoMu.Unlock()
+	if !ok { errorLine(w, "No pending video request."); return }
+	requester := req.from
 
-	sid := generateSID()
-	base := os.Getenv("VIDEO_BASE_URL")
-	if base == "" { base = "http://127.0.0.1:5001" }
+	sid := s.newSID()
+	s.reconcileCalls(callee, requester)
+	s.mu.Lock()
+	full := s.videoFullLocked(callee, requester) // either may have joined another session since the request
+	if full == "" {
+		s.calls[callee] = append(s.calls[callee], sid); s.calls[requester] = append(s.calls[requester], sid)
+		s.callStarted[sid] = time.Now()
+	}
+	s.mu.Unlock()
+	if full != "" {
+		errorLine(w, s.videoFullMessage(callee, full))
+		s.notifyUser(requester, s.videoFullMessage(requester, full))
+		return
+	}
 
-	senderURL := fmt.Sprintf("%s/v/send.html?sid=%s", base, sid)
-    viewerURL := fmt.Sprintf("%s/v/view.html?sid=%s", base, sid)
+	// remembered for /mysession
+	if _, err := s.execRetry(`INSERT INTO video_sessions(sid, sender, viewer, two_way) VALUES(?,?,?,?)`, sid, callee, requester, req.call); err != nil {
+		log.Printf("video_sessions: %v\n", err)
+	}
 
+	if req.call {
+		systemLine(w, "Call accepted. Open this URL to join:")
+		systemLine(w, videoLink(sid, "callee"))
+		s.notifyUser(requester, callee+" accepted. Open this URL to join the call:", videoLink(sid, "caller"))
+		return
+	}
 
 	// In this design, the callee shares camera (as you requested). If you want requester to share instead, swap roles below.
 
 	// Tell both sides
-	if c := s.clients[callee]; c != nil {
-		writeLine(c.w, yellow, "Video approved. Open this URL to share your camera:")
-		writeLine(c.w, yellow, senderURL)
+	systemLine(w, "Video approved. Open this URL to share your camera:")
+	systemLine(w, videoLink(sid, "sender"))
+	s.notifyUser(requester, "Open this URL to view the camera:", videoLink(sid, "viewer"))
+}
+
+// handleVideoCancel is /cancelvideo. videoReq is keyed by callee, so the
+// requester's entry is found by value; finding and deleting it under one hold
+// of s.videoMu means an /acceptvideo racing it either wins or finds nothing.
+func (s *chatServer) handleVideoCancel(w *outbox, requester string) {
+	s.videoMu.Lock()
+	callee, found := "", false
+	for c, req := range s.videoReq {
+		if req.from == requester { callee, found = c, true; delete(s.videoReq, c); break }
+	}
+	s.videoMu.Unlock()
+	if !found { errorLine(w, "You have no pending video request."); return }
+	systemLine(w, "Cancelled your video request to "+callee+".")
+	s.notifyUser(callee, requester+" cancelled the video request.")
+}
+
+func (s *chatServer) handleVideoDecline(w *outbox, callee string) {
+	s.videoMu.Lock(); req, ok := s.videoReq[callee]; if ok { delete(s.videoReq, callee) }; s.videoMu.Unlock()
+	if !ok { errorLine(w, "No pending video request."); return }
+	requester := req.from
+	s.notifyUser(requester, callee+" declined your video request.")
+	systemLine(w, "Declined.")
+}
+
+// videoFullLocked returns the first of users already in -max-video-sessions
+// active sessions, or "". s.mu must be held.
+func (s *chatServer) videoFullLocked(users ...string) string {
+	if s.opts.maxVideo <= 0 { return "" }
+	for _, u := range users {
+		if len(s.calls[u]) >= s.opts.maxVideo { return u }
+	}
+	return ""
+}
+
+// videoFullMessage tells viewer why a video session can't start because full
+// is at the limit.
+func (s *chatServer) videoFullMessage(viewer, full string) string {
+	what, them := "an active video session", "it"
+	if s.opts.maxVideo > 1 { what, them = fmt.Sprintf("%d active video sessions", s.opts.maxVideo), "them" }
+	if viewer == full { return "You already have " + what + " (/endvideo ends " + them + ")." }
+	return full + " already has " + what + "."
+}
+
+// dropCallsLocked removes username's active video sessions from s.calls and
+// returns them with the other participants to tell. s.mu must be held.
+func (s *chatServer) dropCallsLocked(username string) (sids, others []string) {
+	sids = slices.Clone(s.calls[username])
+	for _, sid := range sids {
+		for _, u := range s.dropCallLocked(sid) {
+			if u != username && !slices.Contains(others, u) { others = append(others, u) }
+		}
+	}
+	return sids, others
+}
+
+// dropCallLocked removes sid from every participant's active sessions and
+// returns those participants. s.mu must be held.
+func (s *chatServer) dropCallLocked(sid string) []string {
+	var users []string
+	for u, v := range s.calls {
+		if !slices.Contains(v, sid) { continue }
+		v = slices.DeleteFunc(v, func(x string) bool { return x == sid })
+		if len(v) == 0 { delete(s.calls, u) } else { s.calls[u] = v }
+		users = append(users, u)
+	}
+	delete(s.callStarted, sid)
+	return users
+}
+
+// videoJoinGrace is how long after /acceptvideo a session counts as active
+// without asking the signaling server, since the browsers may not have
+// connected yet.
+const videoJoinGrace = 2 * time.Minute
+
+// reconcileCalls stops counting users' sessions that have ended on the
+// signaling server, where both tabs closed without either user leaving chat,
+// and any older than videoSessionTTL. Only -max-video-sessions needs this.
+func (s *chatServer) reconcileCalls(users ...string) {
+	if s.opts.maxVideo <= 0 { return }
+	type call struct{ sid string; started time.Time }
+	var check []call
+	s.mu.Lock()
+	for _, u := range users {
+		for _, sid := range s.calls[u] {
+			if t := s.callStarted[sid]; time.Since(t) >= videoJoinGrace && !slices.Contains(check, call{sid, t}) { check = append(check, call{sid, t}) }
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range check {
+		if time.Since(c.started) < videoSessionTTL && s.videoActive(c.sid) { continue }
+		s.mu.Lock(); s.dropCallLocked(c.sid); s.mu.Unlock()
+		go s.endVideoSession(c.sid)
+	}
+}
+
+// videoActive asks the signaling server's /active whether anyone is still
+// connected to sid. Without VIDEO_END_TOKEN, or if the server can't be
+// reached, it can't tell and says yes.
+func (s *chatServer) videoActive(sid string) bool {
+	tok := os.Getenv("VIDEO_END_TOKEN")
+	if tok == "" { return true }
+	q := url.Values{"sid": {sid}}
+	if instance := os.Getenv("VIDEO_INSTANCE"); instance != "" { q.Set("instance", instance) }
+	req, err := http.NewRequest(http.MethodGet, videoBaseURL()+"/active?"+q.Encode(), nil)
+	if err != nil { return true }
+	req.Header.Set("Authorization", "Bearer "+tok)
+	resp, err := (&http.Client{Timeout: 2 * time.Second}).Do(req)
+	if err != nil {
+		log.Printf("Check video session %s: %v\n", sid, err)
+		return true
+	}
+	resp.Body.Close()
+	return resp.StatusCode != http.StatusNotFound
+}
+
+// handleEndVideo is /endvideo: ends every video session username is in,
+// here and on the signaling server.
+func (s *chatServer) handleEndVideo(w *outbox, username string) error {
+	s.mu.Lock(); sids, others := s.dropCallsLocked(username); s.mu.Unlock()
+	if len(sids) == 0 { return errors.New("You have no active video session.") }
+	for _, u := range others {
+		s.notifyUser(u, fmt.Sprintf("Video session ended (%s ended it).", username))
+	}
+	for _, sid := range sids { go s.endVideoSession(sid) }
+	systemLine(w, fmt.Sprintf("Ended %d video session(s).", len(sids)))
+	return nil
+}
+
+// videoSessionTTL is how long /mysession offers a session that never ended
+// cleanly, e.g. because the chat server restarted mid-call.
+const videoSessionTTL = 4 * time.Hour
+
+// handleMySession is /mysession: the URL for the user's side of their most
+// recent video session that hasn't ended, for when the browser tab was closed.
+func (s *chatServer) handleMySession(w *outbox, username string) {
+	var sid, sender string
+	var twoWay bool
+	cutoff := time.Now().UTC().Add(-videoSessionTTL).Format(dbTimeLayout)
+	err := s.db.QueryRow(`SELECT sid, sender, two_way FROM video_sessions
+WHERE (sender=? OR viewer=?) AND ended_at IS NULL AND created_at>=?
+ORDER BY created_at DESC, rowid DESC LIMIT 1`, username, username, cutoff).Scan(&sid, &sender, &twoWay)
+	if err != nil {
+		systemLine(w, "You have no active video session.")
+		return
+	}
+	if twoWay {
+		role := "caller" // the viewer column holds whoever asked
+		if sender == username { role = "callee" }
+		systemLine(w, "Open this URL to join the call:")
+		systemLine(w, videoLink(sid, role))
+		return
 	}
-	if r := s.clients[requester]; r != nil {
-		writeLine(r.w, yellow, "Open this URL to view the camera:")
-		writeLine(r.w, yellow, viewerURL)
+	if sender == username {
+		systemLine(w, "Open this URL to share your camera:")
+		systemLine(w, videoLink(sid, "sender"))
+		return
+	}
+	systemLine(w, "Open this URL to view the camera:")
+	systemLine(w, videoLink(sid, "viewer"))
+}
+
+// videoPages maps a signaling role to the page that plays it.
+var videoPages = map[string]string{"sender": "send.html", "viewer": "view.html", "caller": "call.html", "callee": "call.html"}
+
+// videoLink is what a participant opens to join session sid as role. Pages are
+// served from VIDEO_PAGES_URL (default VIDEO_BASE_URL); when that's elsewhere,
+// e.g. a CDN, the link carries the signaling WebSocket in ws=, which the pages
+// only follow when its origin is in their video-ws-allow list (-ws-allow). With
+// VIDEO_PAGES_URL=off the signaling server serves no pages, so the link is the
+// WebSocket itself plus the sid and role a client must send in its hello.
+// VIDEO_INSTANCE, when set, namespaces sid so several chat servers can share
+// one signaling server; it's carried in the link and sent in the hello too.
+func videoLink(sid, role string) string {
+	pages, instance := os.Getenv("VIDEO_PAGES_URL"), os.Getenv("VIDEO_INSTANCE")
+	if pages == "off" {
+		if instance != "" { return fmt.Sprintf("%s  sid=%s role=%s instance=%s", videoWSURL(), sid, role, instance) }
+		return fmt.Sprintf("%s  sid=%s role=%s", videoWSURL(), sid, role)
+	}
+	q := url.Values{"sid": {sid}}
+	if instance != "" { q.Set("instance", instance) }
+	if role == "caller" || role == "callee" { q.Set("role", role) }
+	if pages == "" {
+		pages = videoBaseURL()
+	} else if pages != videoBaseURL() {
+		q.Set("ws", videoWSURL())
 	}
+	return fmt.Sprintf("%s/v/%s?%s", pages, videoPages[role], q.Encode())
+}
+
+// videoWSURL is the signaling WebSocket under VIDEO_BASE_URL.
+func videoWSURL() string {
+	base := videoBaseURL()
+	if rest, ok := strings.CutPrefix(base, "https://"); ok { return "wss://" + rest + "/ws" }
+	return "ws://" + strings.TrimPrefix(base, "http://") + "/ws"
 }
 
-func (s *chatServer) handleVideoDecline(callee string) {
-	s.mu.Lock(); requester, ok := s.videoReq[callee]; if ok { delete(s.videoReq, callee) }; s.mu.Unlock()
-	if !ok { if c := s.clients[callee]; c != nil { writeLine(c.w, yellow, "No pending video request.") }; return }
-	if r := s.clients[requester]; r != nil { writeLine(r.w, yellow, callee+" declined your video request.") }
-	if c := s.clients[callee]; c != nil { writeLine(c.w, yellow, "Declined.") }
+func videoBaseURL() string {
+	if base := os.Getenv("VIDEO_BASE_URL"); base != "" { return base }
+	return "http://127.0.0.1:5001"
+}
+
+// endVideoSession asks the signaling server to close both browsers' WebSockets
+// for sid. The signaling server only honours this with VIDEO_END_TOKEN set on
+// both services; without it only video_sessions is updated.
+func (s *chatServer) endVideoSession(sid string) {
+	if _, err := s.execRetry(`UPDATE video_sessions SET ended_at=CURRENT_TIMESTAMP WHERE sid=? AND ended_at IS NULL`, sid); err != nil {
+		log.Printf("video_sessions: %v\n", err)
+	}
+	tok := os.Getenv("VIDEO_END_TOKEN")
+	if tok == "" { return }
+	q := url.Values{"sid": {sid}}
+	if instance := os.Getenv("VIDEO_INSTANCE"); instance != "" { q.Set("instance", instance) }
+	req, err := http.NewRequest(http.MethodPost, videoBaseURL()+"/end?"+q.Encode(), nil)
+	if err != nil { return }
+	req.Header.Set("Authorization", "Bearer "+tok)
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Printf("End video session %s: %v\n", sid, err)
+		return
+	}
+	resp.Body.Close()
 }
 
 func generateSID() string {
@@ -355,38 +4562,688 @@ func generateSID() string {
 	return string(b)
 }
 
-func (s *chatServer) systemBroadcast(exclude, msg string) {
+// broadcastPresence is the one place presence changes are announced: it tells
+// every other online user "<user> <state>" (AFK, /status...), skipping anyone
+// who has blocked user.
+func (s *chatServer) broadcastPresence(user, state string) { s.announce(user, state, false) }
+
+// broadcastJoin is broadcastPresence for joined and left, which each user can
+// mute with /joins off.
+func (s *chatServer) broadcastJoin(user, state string) { s.announce(user, state, true) }
+
+func (s *chatServer) announce(user, state string, join bool) {
 	s.mu.Lock()
-	receivers := make([]*userConn, 0, len(s.clients))
-	for u, c := range s.clients {
-		if u == exclude || c == nil {
+	var receivers []*userConn
+	for u, cs := range s.clients {
+		if u == user {
 			continue
 		}
-		receivers = append(receivers, c)
+		for _, uc := range cs {
+			if join && uc.prefs["joins"] == "off" {
+				continue
+			}
+			receivers = append(receivers, uc)
+		}
 	}
 	s.mu.Unlock()
 
 	for _, uc := range receivers {
-		writeLine(uc.w, yellow, msg)
-		writePrompt(uc.w, uc.name)
+		if s.isBlocked(uc.name, user) { continue }
+		s.notifySystem(uc, user+" "+state)
 	}
 }
 
 // ===== Helpers =====
 
-func write(w *bufio.Writer, color, s string) {
-	_, _ = w.WriteString(color + s + reset)
-	_ = w.Flush()
+func write(w *outbox, color, s string) {
+	w.send(color + s + reset)
+}
+func writeLine(w *outbox, color, s string) {
+	w.send(color + s + reset + "\r\n")
+}
+
+// With the tags pref on, system and error lines start with one of these, ahead
+// of any color, so a client can route them away from the chat pane. Chat lines
+// and prompts are never tagged.
+const (
+	sysTag = "!SYS! "
+	errTag = "!ERR! "
+)
+
+// systemLine writes a server notice in the system color.
+func systemLine(w *outbox, s string) {
+	w.send(w.tag(sysTag) + colors.system + s + reset + "\r\n")
+}
+
+// errorLine is systemLine for something that went wrong: a failed command or
+// bad usage. It looks the same unless the connection has tags on.
+func errorLine(w *outbox, s string) {
+	w.send(w.tag(errTag) + colors.system + s + reset + "\r\n")
+}
+
+// userColor resolves a sender's display color: their /color choice if they
+// made one, else the original default (cyan for zohaib, green otherwise).
+func (s *chatServer) userColor(u string) string {
+	s.mu.Lock(); c, ok := s.userColors[u]; s.mu.Unlock()
+	if ok { return c }
+	var name sql.NullString
+	_ = s.db.QueryRow(`SELECT color FROM users WHERE username=?`, u).Scan(&name)
+	c = green
+	if u == zohaibUser { c = cyan }
+	if code, ok := colorNames[name.String]; ok { c = code }
+	s.mu.Lock(); s.userColors[u] = c; s.mu.Unlock()
+	return c
+}
+
+// ===== Ping =====
+// /ping-peer sends "!PING! <id>" to each of the peer's sessions that has tags
+// on, i.e. a client that hides tagged lines and can answer. The first /pong
+// <id> back gives the round trip. Text-mode sessions never see the probe, so
+// without a cooperating client the requester gets connection info instead.
+
+// pingTag starts a /ping-peer probe line; see sysTag.
+const pingTag = "!PING! "
+
+// pingTimeout is how long /ping-peer waits for a /pong.
+const pingTimeout = 5 * time.Second
+
+type pendingPing struct {
+	from, to string
+	uc       *userConn // the requester's session, which gets the answer
+	sent     time.Time
+	timer    *time.Timer
+}
+
+func (s *chatServer) pingPeer(w *outbox, username string) error {
+	peer := s.peerOf(username)
+	dsts := s.sessions(peer)
+	if len(dsts) == 0 { return errors.New(peer + " is offline.") }
+	var tagged []*userConn
+	for _, dst := range dsts {
+		if dst.w.tagged.Load() { tagged = append(tagged, dst) }
+	}
+	if len(tagged) == 0 {
+		systemLine(w, s.connectedLine(peer, dsts)+" Their client can't answer pings, so no round-trip time.")
+		return nil
+	}
+	uc := s.session(username, w)
+	if uc == nil { return nil }
+	s.mu.Lock()
+	s.pingSeq++
+	id := strconv.FormatInt(s.pingSeq, 10)
+	p := &pendingPing{from: username, to: peer, uc: uc, sent: time.Now()}
+	s.pings[id] = p
+	p.timer = time.AfterFunc(pingTimeout, func() {
+		s.mu.Lock(); _, waiting := s.pings[id]; delete(s.pings, id); s.mu.Unlock()
+		if waiting { s.notifySystem(uc, fmt.Sprintf("No reply from %s in %s. %s", peer, pingTimeout, s.connectedLine(peer, s.sessions(peer)))) }
+	})
+	s.mu.Unlock()
+	for _, dst := range tagged { dst.w.send(pingTag + id + "\r\n") }
+	systemLine(w, "Pinging "+peer+"...")
+	return nil
+}
+
+// pong completes the /ping-peer with this id, if username is the one pinged.
+func (s *chatServer) pong(username, id string) {
+	s.mu.Lock()
+	p := s.pings[id]
+	if p == nil || p.to != username { s.mu.Unlock(); return }
+	delete(s.pings, id)
+	s.mu.Unlock()
+	p.timer.Stop()
+	s.notifySystem(p.uc, fmt.Sprintf("Pong from %s: %s.", username, time.Since(p.sent).Round(100*time.Microsecond)))
+}
+
+// connectedLine says how long u has been connected, from their oldest session.
+func (s *chatServer) connectedLine(u string, sessions []*userConn) string {
+	if len(sessions) == 0 { return u + " is offline." }
+	line := fmt.Sprintf("%s is connected, for %s", u, time.Since(sessions[0].since).Round(time.Second))
+	if len(sessions) > 1 { line += fmt.Sprintf(" (%d sessions)", len(sessions)) }
+	return line + "."
+}
+
+// ===== Preferences =====
+// Per-user settings are key/value strings in user_prefs, copied into the
+// userConn at attach so they persist across reconnects. /set and /get manage
+// any of them; /echo, /width and /tz are shorthands for their own key.
+
+type prefDef struct {
+	def   string                         // value when unset
+	parse func(v string) (string, error) // validates a /set value and normalizes it
+}
+
+var prefDefs = map[string]prefDef{
+	"echo":  {"off", parseOnOff},
+	"width": {"off", parseWidth},
+	"tz":    {"", parseTZ}, // "" = the server's -tz
+	"acks":  {"on", parseOnOff}, // /ack-request reminders
+	"tags":  {"off", parseOnOff}, // mark system and error lines for clients
+	"bell":  {"off", parseOnOff},
+	"joins": {"on", parseOnOff}, // "joined"/"left" notices for others
+}
+
+func parseOnOff(v string) (string, error) {
+	if v != "on" && v != "off" { return "", errors.New("Expected on or off.") }
+	return v, nil
+}
+
+func parseWidth(v string) (string, error) {
+	if v == "off" { return v, nil }
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 40 || n > 1000 { return "", errors.New("Expected columns from 40 to 1000, or off.") }
+	return strconv.Itoa(n), nil
+}
+
+func parseTZ(v string) (string, error) {
+	loc, err := time.LoadLocation(v)
+	if err != nil || v == "Local" { return "", errors.New("Unknown timezone " + v + " (try e.g. Europe/London or UTC).") }
+	return loc.String(), nil
+}
+
+func (s *chatServer) loadPrefs(username string) map[string]string {
+	prefs := make(map[string]string)
+	rows, err := s.db.Query(`SELECT key, value FROM user_prefs WHERE username=?`, username)
+	if err != nil { log.Printf("load prefs for %s: %v\n", username, err); return prefs }
+	defer rows.Close()
+	for rows.Next() {
+		var k, v string
+		if rows.Scan(&k, &v) == nil { prefs[k] = v }
+	}
+	return prefs
+}
+
+// pref is u's value for key: from their connection if they're online, else
+// from the table, else the default.
+func (s *chatServer) pref(u, key string) string {
+	s.mu.Lock()
+	uc := s.primary(u)
+	var v string
+	ok := false
+	if uc != nil { v, ok = uc.prefs[key] }
+	s.mu.Unlock()
+	if uc == nil {
+		ok = s.db.QueryRow(`SELECT value FROM user_prefs WHERE username=? AND key=?`, u, key).Scan(&v) == nil
+	}
+	if !ok { v = prefDefs[key].def }
+	return v
+}
+
+// setPref saves value (already parsed) for key; "" removes it, back to the default.
+func (s *chatServer) setPref(u, key, value string) error {
+	var err error
+	if value == "" {
+		_, err = s.execRetry(`DELETE FROM user_prefs WHERE username=? AND key=?`, u, key)
+	} else {
+		_, err = s.execRetry(`INSERT INTO user_prefs(username, key, value) VALUES(?, ?, ?)
+ON CONFLICT(username, key) DO UPDATE SET value=excluded.value`, u, key, value)
+	}
+	if err != nil {
+		log.Printf("set pref %s for %s: %v\n", key, u, err)
+		return errors.New("Could not save your preference.")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key == "tz" { delete(s.userLocs, u) }
+	for _, uc := range s.clients[u] {
+		if value == "" { delete(uc.prefs, key) } else { uc.prefs[key] = value }
+		uc.apply(key)
+	}
+	return nil
+}
+
+// apply copies a pref into the typed field the hot paths read. Callers hold
+// s.mu, or own uc before it's attached.
+func (uc *userConn) apply(key string) {
+	switch key {
+	case "echo":
+		uc.echo = uc.prefs[key] == "on"
+	case "bell":
+		uc.bell = uc.prefs[key] == "on"
+	case "width":
+		uc.width, _ = strconv.Atoi(uc.prefs[key]) // "off" or unset -> 0
+	case "tags":
+		uc.w.tagged.Store(uc.prefs[key] == "on")
+	}
+}
+
+// handleSet is /set: list every pref, or set or reset one.
+func (s *chatServer) handleSet(w *outbox, username string, args []string) {
+	if len(args) == 0 {
+		keys := make([]string, 0, len(prefDefs))
+		for k := range prefDefs { keys = append(keys, k) }
+		sort.Strings(keys)
+		for _, k := range keys { systemLine(w, prefLine(k, s.pref(username, k))) }
+		return
+	}
+	def, ok := prefDefs[args[0]]
+	if !ok { errorLine(w, "Unknown preference "+args[0]+". Type /set for the list."); return }
+	if len(args) != 2 { errorLine(w, "Usage: /set <key> <value>|reset"); return }
+	v := ""
+	if args[1] != "reset" {
+		var err error
+		if v, err = def.parse(args[1]); err != nil { systemLine(w, err.Error()); return }
+	}
+	if err := s.setPref(username, args[0], v); err != nil { systemLine(w, err.Error()); return }
+	systemLine(w, prefLine(args[0], s.pref(username, args[0])))
+}
+
+func prefLine(key, value string) string {
+	if value == "" { value = "(server default)" }
+	return key + "=" + value
+}
+
+// ===== Timestamps =====
+// Message times are stored in UTC and rendered per viewer: in their /tz zone
+// (the tz pref) or the server's -tz, using -time-format, with the date in front
+// for messages not from today when -show-date is set.
+
+// stamp renders t for viewer.
+func (s *chatServer) stamp(viewer string, t time.Time) string {
+	loc := s.userLoc(viewer)
+	t = t.In(loc)
+	out := t.Format(s.opts.timeFormat)
+	if s.opts.showDate {
+		y, m, d := t.Date()
+		if ny, nm, nd := time.Now().In(loc).Date(); y != ny || m != nm || d != nd {
+			out = t.Format("2006-01-02") + " " + out
+		}
+	}
+	return out
+}
+
+// dbStamp renders a messages.ts value (dbTimeLayout, UTC) for viewer.
+func (s *chatServer) dbStamp(viewer, ts string) string {
+	t, err := time.Parse(dbTimeLayout, ts)
+	if err != nil { return ts }
+	return s.stamp(viewer, t)
+}
+
+// dbDateStamp is dbStamp with the date always shown, for times that may be
+// long past.
+func (s *chatServer) dbDateStamp(viewer, ts string) string {
+	t, err := time.Parse(dbTimeLayout, ts)
+	if err != nil { return ts }
+	return t.In(s.userLoc(viewer)).Format("2006-01-02 ") + t.In(s.userLoc(viewer)).Format(s.opts.timeFormat)
+}
+
+// userLoc is the user's /tz zone, or -tz.
+func (s *chatServer) userLoc(u string) *time.Location {
+	s.mu.Lock(); loc, ok := s.userLocs[u]; s.mu.Unlock()
+	if ok { return loc }
+	loc = s.opts.tz
+	if name := s.pref(u, "tz"); name != "" {
+		if l, err := time.LoadLocation(name); err == nil { loc = l }
+	}
+	s.mu.Lock(); s.userLocs[u] = loc; s.mu.Unlock()
+	return loc
+}
+
+// handleTZ is /tz [zone|reset]: show or set the timezone timestamps render in.
+func (s *chatServer) handleTZ(w *outbox, username, arg string) {
+	if arg == "" {
+		systemLine(w, "Your timezone: "+s.userLoc(username).String()+". Usage: /tz <Area/City|UTC|reset>")
+		return
+	}
+	stored := "" // unset = back to -tz
+	if arg != "reset" {
+		v, err := parseTZ(arg)
+		if err != nil { systemLine(w, err.Error()); return }
+		stored = v
+	}
+	if err := s.setPref(username, "tz", stored); err != nil { systemLine(w, err.Error()); return }
+	systemLine(w, "Timestamps now show in "+s.userLoc(username).String()+": "+s.stamp(username, time.Now()))
+}
+
+// timeLine reports now as RFC 3339 UTC, so clients can compute their offset
+// from the server clock, along with the zone timestamps are rendered in.
+func (s *chatServer) timeLine(viewer string, now time.Time) string {
+	return fmt.Sprintf("Server time: %s (server timezone %s, yours %s).",
+		now.UTC().Format(time.RFC3339), s.opts.tz, s.userLoc(viewer))
+}
+
+// liveLines is a message as delivered live to its recipient, wrapped to width.
+func liveLines(w *outbox, from, to, text, ts string, action bool, width int) []string {
+	return wrapMessage(mentionMark(text, to)+w.header(ts, from, action), text, width)
+}
+
+// formatMessage renders a chat line for w; actions (/me) read IRC-style as
+// "* bilal waves".
+func formatMessage(w *outbox, ts, sender, text string, action bool) string {
+	return w.header(ts, sender, action) + text
+}
+
+// messageHeader is the part of formatMessage before the text.
+func messageHeader(ts, sender string, action bool) string {
+	if action { return fmt.Sprintf("[%s] * %s ", ts, sender) }
+	return fmt.Sprintf("[%s] %s: ", ts, sender)
+}
+
+// header is messageHeader for this connection: with colors off the sender is
+// tagged "<bilal>", since there's no color to tell the two apart.
+func (o *outbox) header(ts, sender string, action bool) string {
+	if o.plain.Load() && !action { return fmt.Sprintf("[%s] <%s> ", ts, sender) }
+	return messageHeader(ts, sender, action)
+}
+
+// ===== Soft wrap =====
+// With /width set, messages are wrapped to that many columns on word boundaries,
+// continuation lines indented to line up under the text after the prefix.
+// Widths are terminal cells, not bytes: CJK and emoji take two, combining marks none.
+
+// wrapMessage returns prefix+text as one line when width is 0, else wrapped.
+// Runs of spaces collapse when wrapping.
+func wrapMessage(prefix, text string, width int) []string {
+	if width <= 0 { return []string{prefix + text} }
+	indent := displayWidth(prefix)
+	if width-indent < minWrapText { indent = 2 } // prefix too wide: hang under it instead
+	pad := strings.Repeat(" ", indent)
+	var lines []string
+	cur, curW, empty := prefix, displayWidth(prefix), true // empty: no word on cur yet
+	for _, word := range strings.Fields(text) {
+		ww := displayWidth(word)
+		if !empty && curW+1+ww > width {
+			lines = append(lines, cur)
+			cur, curW, empty = pad, indent, true
+		}
+		if !empty { cur += " "; curW++ }
+		for curW+ww > width { // longer than a line: break it by cells
+			head, hw := cutWidth(word, width-curW)
+			cur, word, ww = cur+head, word[len(head):], ww-hw
+			lines = append(lines, cur)
+			cur, curW = pad, indent
+		}
+		cur, curW, empty = cur+word, curW+ww, false
+	}
+	return append(lines, cur)
+}
+
+// minWrapText is the fewest columns left for text before continuation lines
+// stop lining up under the prefix.
+const minWrapText = 20
+
+// cutWidth returns the longest prefix of s at most w cells wide, and its width.
+func cutWidth(s string, w int) (string, int) {
+	n := 0
+	for i, r := range s {
+		rw := runeWidth(r)
+		if n+rw > w { return s[:i], n }
+		n += rw
+	}
+	return s, n
+}
+
+// displayWidth is the number of terminal cells s occupies, ignoring ANSI escapes.
+func displayWidth(s string) int {
+	n, esc := 0, false
+	for _, r := range s {
+		switch {
+		case esc:
+			if (r >= 'A' && r <= 'Z') || (r >= 'a' && r <= 'z') { esc = false }
+		case r == 0x1b:
+			esc = true
+		default:
+			n += runeWidth(r)
+		}
+	}
+	return n
+}
+
+// runeWidth approximates wcwidth: 0 for combining and format characters, 2 for
+// East Asian wide/fullwidth characters and emoji, 1 otherwise.
+func runeWidth(r rune) int {
+	switch {
+	case r < 0x20 || r == 0x7f:
+		return 0
+	case r < 0x300:
+		return 1
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf), r >= 0xfe00 && r <= 0xfe0f:
+		return 0
+	case r >= 0x1100 && r <= 0x115f, r >= 0x2e80 && r <= 0x303e, r >= 0x3041 && r <= 0x33ff,
+		r >= 0x3400 && r <= 0x4dbf, r >= 0x4e00 && r <= 0x9fff, r >= 0xa000 && r <= 0xa4cf,
+		r >= 0xac00 && r <= 0xd7a3, r >= 0xf900 && r <= 0xfaff, r >= 0xfe30 && r <= 0xfe4f,
+		r >= 0xff00 && r <= 0xff60, r >= 0xffe0 && r <= 0xffe6,
+		r >= 0x1f300 && r <= 0x1f64f, r >= 0x1f680 && r <= 0x1f6ff, r >= 0x1f900 && r <= 0x1faff,
+		r >= 0x20000 && r <= 0x3fffd:
+		return 2
+	}
+	return 1
+}
+
+func (s *chatServer) widthOf(u string) int {
+	s.mu.Lock(); defer s.mu.Unlock()
+	if uc := s.primary(u); uc != nil { return uc.width }
+	return 0
+}
+
+var mentionRe = regexp.MustCompile(`(?:^|[^\w@])@(\w+)`)
+
+// mentions reports whether text @-mentions user (case-insensitive).
+func mentions(text, user string) bool {
+	for _, m := range mentionRe.FindAllStringSubmatch(text, -1) {
+		if strings.EqualFold(m[1], user) { return true }
+	}
+	return false
+}
+
+// mentionMark is the highlighted prefix for a message that mentions its recipient.
+func mentionMark(text, recipient string) string {
+	if !mentions(text, recipient) { return "" }
+	return "\x1b[1m(you were mentioned)\x1b[22m "
+}
+
+// defaultPrompt is the prompt format for users who haven't set one with /prompt.
+const defaultPrompt = "> "
+
+// maxPromptLen caps a /prompt format, in runes.
+const maxPromptLen = 40
+
+// maxStatusLen caps a /status text, in runes.
+const maxStatusLen = 80
+
+// sanitizeLine drops control characters (ESC included, so user text shown to
+// others can't carry its own ANSI sequences) and truncates to max runes.
+func sanitizeLine(text string, max int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range text {
+		if r < 0x20 || r == 0x7f || (r >= 0x80 && r < 0xa0) { continue }
+		if n == max { break }
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// promptFormat is the user's /prompt format, or defaultPrompt.
+func (s *chatServer) promptFormat(u string) string {
+	s.mu.Lock(); f, ok := s.userPrompts[u]; s.mu.Unlock()
+	if ok { return f }
+	var stored sql.NullString
+	_ = s.db.QueryRow(`SELECT prompt FROM users WHERE username=?`, u).Scan(&stored)
+	f = defaultPrompt
+	if stored.Valid && stored.String != "" { f = stored.String }
+	s.mu.Lock(); s.userPrompts[u] = f; s.mu.Unlock()
+	return f
+}
+
+// renderPrompt expands %u (user), %p (peer), %t (HH:MM) and %% in format.
+// Unknown tokens are left as typed.
+func (s *chatServer) renderPrompt(format, u string) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) { b.WriteByte(format[i]); continue }
+		switch format[i+1] {
+		case 'u': b.WriteString(u)
+		case 'p': b.WriteString(s.peerOf(u))
+		case 't': b.WriteString(time.Now().Format("15:04"))
+		case '%': b.WriteByte('%')
+		default:  b.WriteString(format[i : i+2])
+		}
+		i++
+	}
+	return b.String()
+}
+
+func (s *chatServer) promptSymbol(u string) string {
+	p := s.renderPrompt(s.promptFormat(u), u)
+	if colors.prompt != "" { return colors.prompt + p + reset }
+	return s.userColor(u) + p + reset
+}
+func (s *chatServer) writePrompt(w *outbox, u string) {
+	w.send(s.promptSymbol(u))
+}
+
+// clearLine erases the terminal line the cursor is on.
+const clearLine = "\r\x1b[2K"
+
+// clearScreen erases the whole terminal and homes the cursor.
+const clearScreen = "\x1b[2J\x1b[H"
+
+// bel is the ASCII bell, sent ahead of incoming messages with /bell on.
+const bel = "\a"
+
+// notify writes unsolicited lines (incoming messages, video prompts, broadcasts)
+// to a logged-in user. The line they may be halfway through typing is cleared
+// first and the prompt redrawn after, so the notice doesn't interleave with their
+// input. It's one send, so nothing else can land in between.
+func (s *chatServer) notify(uc *userConn, color string, lines ...string) {
+	s.notifyAs(uc, "", color, lines)
+}
+
+// notifySystem is notify for server notices, tagged like systemLine.
+func (s *chatServer) notifySystem(uc *userConn, lines ...string) {
+	s.notifyAs(uc, sysTag, colors.system, lines)
 }
-func writeLine(w *bufio.Writer, color, s string) {
-	_, _ = w.WriteString(color + s + reset + "\r\n")
-	_ = w.Flush()
+
+func (s *chatServer) notifyAs(uc *userConn, tag, color string, lines []string) {
+	tag = uc.w.tag(tag)
+	var b strings.Builder
+	b.WriteString(clearLine)
+	for _, l := range lines {
+		b.WriteString(tag + color + l + reset + "\r\n")
+	}
+	b.WriteString(s.promptSymbol(uc.name))
+	uc.w.send(b.String())
+}
+
+// ===== Outbound queue =====
+// With /compress on, the writer switches to a raw DEFLATE stream (RFC 1951,
+// compress/flate) in both directions, flushed after every batch so each line
+// arrives promptly. Clients must implement the same: after sending
+// "/compress on" and reading the "Compression on." ack, inflate everything the
+// server sends and deflate (with a sync flush per line) everything they send.
+//
+// Every write to a connection goes through its outbox: producers (the user's own
+// handler, peers' deliveries, broadcasts) enqueue without blocking, and a single
+// writer goroutine drains the queue to the socket. A client that falls more than
+// outboxSize writes behind is disconnected rather than stalling everyone else,
+// and so is one whose socket takes no bytes for -write-timeout, which would
+// otherwise park the writer goroutine for good.
+
+const outboxSize = 256
+
+type outbox struct {
+	conn    net.Conn
+	timeout time.Duration // per-write deadline; 0 = none
+	tagged  atomic.Bool // the user's tags pref; see systemLine
+	plain   atomic.Bool // "caps colors=off": strip ANSI escapes; see header
+
+	mu     sync.Mutex
+	ch     chan outItem
+	closed bool
+}
+
+// outItem is one queued write, or the point where output switches to DEFLATE.
+type outItem struct {
+	s        string
+	compress bool
+}
+
+func newOutbox(conn net.Conn, timeout time.Duration) *outbox {
+	o := &outbox{conn: conn, timeout: timeout, ch: make(chan outItem, outboxSize)}
+	go o.run()
+	return o
+}
+
+// tag is t if the connection wants tagged output, else "".
+func (o *outbox) tag(t string) string {
+	if o.tagged.Load() { return t }
+	return ""
+}
+
+// send queues s for the connection; it never blocks.
+func (o *outbox) send(s string) {
+	if o.plain.Load() { s = ansiRe.ReplaceAllString(s, "") }
+	o.queue(outItem{s: s})
+}
+
+// ansiRe matches the CSI escapes the server writes: colors, bold, line clears.
+var ansiRe = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+
+// startCompression makes everything sent after it go out DEFLATE-compressed.
+func (o *outbox) startCompression() { o.queue(outItem{compress: true}) }
+
+func (o *outbox) queue(it outItem) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed { return }
+	select {
+	case o.ch <- it:
+	default:
+		log.Printf("Outbound queue full for %s; disconnecting\n", o.conn.RemoteAddr())
+		o.closed = true
+		close(o.ch)
+		_ = o.conn.Close()
+	}
 }
-func promptSymbol(u string) string {
-	if u == bilalUser { return green + "> " + reset }
-	return cyan + "> " + reset
+
+// close stops accepting output; run flushes what's queued and closes the conn.
+func (o *outbox) close() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed { return }
+	o.closed = true
+	close(o.ch)
 }
-func writePrompt(w *bufio.Writer, u string) {
-	_, _ = w.WriteString(promptSymbol(u))
-	_ = w.Flush()
+
+func (o *outbox) run() {
+	defer o.conn.Close()
+	bw := bufio.NewWriter(o.conn)
+	var fw *flate.Writer // non-nil once compression is on
+	deadline := func() {
+		if o.timeout > 0 { _ = o.conn.SetWriteDeadline(time.Now().Add(o.timeout)) }
+	}
+	flush := func() error {
+		if fw != nil {
+			if err := fw.Flush(); err != nil { return err }
+		}
+		return bw.Flush()
+	}
+	defer func() {
+		if fw != nil { deadline(); _ = fw.Close(); _ = bw.Flush() }
+	}()
+	var err error
+	for it := range o.ch {
+		deadline()
+		if it.compress {
+			if fw != nil { continue }
+			if err = bw.Flush(); err != nil { break }
+			fw, _ = flate.NewWriter(bw, flate.BestSpeed) // only fails for a bad level
+			continue
+		}
+		if fw != nil { _, err = fw.Write([]byte(it.s)) } else { _, err = bw.WriteString(it.s) }
+		if err != nil { break }
+		// batch whatever is already queued into one flush
+		if len(o.ch) == 0 {
+			if err = flush(); err != nil { break }
+		}
+	}
+	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			log.Printf("Write to %s timed out after %s; disconnecting\n", o.conn.RemoteAddr(), o.timeout)
+		}
+		_ = o.conn.Close() // ends the handler's read too, rather than waiting for it to notice
+	}
+	for range o.ch { // drain after a write error so send never sees a full queue forever
+	}
 }
\ No newline at end of file
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newTestServer returns a server on its own in-memory database, with no
+// seeded accounts.
+func newTestServer(t *testing.T, opts options) *chatServer {
+	t.Helper()
+	db, err := sql.Open("sqlite", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if opts.admin == "" {
+		opts.admin = "bilal"
+	}
+	opts.noSeed = true
+	s, err := newServer(db, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// pipeClient collects everything the server writes to conn: the far end of a
+// net.Pipe, or a connection dialed to serve.
+type pipeClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+	out  strings.Builder
+	done chan struct{} // closed once the server closes the connection
+}
+
+func newPipeClient(t *testing.T, conn net.Conn) *pipeClient {
+	c := &pipeClient{conn: conn, done: make(chan struct{})}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		defer close(c.done)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			c.mu.Lock()
+			c.out.Write(buf[:n])
+			c.mu.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// session attaches a session for username and returns its outbox and a
+// client reading what the server writes to it.
+func session(t *testing.T, s *chatServer, username string) (*outbox, *pipeClient) {
+	t.Helper()
+	srv, cli := net.Pipe()
+	w := newOutbox(srv, 0)
+	t.Cleanup(w.close)
+	s.attach(username, srv, w)
+	return w, newPipeClient(t, cli)
+}
+
+// waitOutput waits until c has been sent every one of want.
+func waitOutput(t *testing.T, c *pipeClient, want ...string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		got := c.out.String()
+		c.mu.Unlock()
+		missing := ""
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				missing = w
+				break
+			}
+		}
+		if missing == "" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want output containing %q, got %q", missing, got)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// The username ends at the first run of spaces or tabs; the password is the
+// rest of the line exactly as typed.
+func TestParseLogin(t *testing.T) {
+	for _, tc := range []struct {
+		raw, user, pass string
+		ok              bool
+	}{
+		{"login bilal secret", "bilal", "secret", true},
+		{"login bilal  two  spaces ", "bilal", "two  spaces ", true},
+		{"login\tbilal\tsecret", "bilal", "secret", true},
+		{"  login   bilal \t pass\tword", "bilal", "pass\tword", true},
+		{"login bilal", "", "", false},
+		{"login bilal   ", "", "", false},
+		{"loginbilal secret", "", "", false},
+		{"login", "", "", false},
+	} {
+		user, pass, ok := parseLogin(tc.raw)
+		if user != tc.user || pass != tc.pass || ok != tc.ok {
+			t.Errorf("parseLogin(%q) = %q, %q, %v; want %q, %q, %v", tc.raw, user, pass, ok, tc.user, tc.pass, tc.ok)
+		}
+	}
+}
+
+// Both links /acceptvideo hands out, and the video_sessions row, carry the sid
+// newSID made for the session.
+func TestVideoAcceptUsesNewSID(t *testing.T) {
+	t.Setenv("VIDEO_PAGES_URL", "")
+	t.Setenv("VIDEO_INSTANCE", "")
+	for _, tc := range []struct {
+		name           string
+		call           bool
+		callee, caller string // what each side's link should contain
+	}{
+		{"view", false, "send.html?sid=fixedsid", "view.html?sid=fixedsid"},
+		{"call", true, "call.html?role=callee&sid=fixedsid", "call.html?role=caller&sid=fixedsid"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestServer(t, options{})
+			s.newSID = func() string { return "fixedsid" }
+			zw, zohaib := session(t, s, "zohaib")
+			_, bilal := session(t, s, "bilal")
+			s.videoReq["zohaib"] = videoRequest{from: "bilal", call: tc.call}
+
+			s.handleVideoAccept(zw, "zohaib")
+			waitOutput(t, zohaib, tc.callee)
+			waitOutput(t, bilal, tc.caller)
+			var sender, viewer string
+			if err := s.db.QueryRow(`SELECT sender, viewer FROM video_sessions WHERE sid='fixedsid'`).Scan(&sender, &viewer); err != nil {
+				t.Fatalf("video_sessions: %v", err)
+			}
+			if sender != "zohaib" || viewer != "bilal" {
+				t.Fatalf("video_sessions: sender %q viewer %q, want zohaib and bilal", sender, viewer)
+			}
+		})
+	}
+}
+
+// lockedDB returns a database file with no busy_timeout, so a write fails at
+// once while another connection holds the lock, and that connection inside a
+// BEGIN EXCLUSIVE.
+func lockedDB(t *testing.T) (*sql.DB, *sql.Conn) {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "chat.db") + "?_pragma=busy_timeout(0)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE t(x INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	other, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { other.Close() })
+	lock, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lock.Close() })
+	if _, err := lock.ExecContext(context.Background(), `BEGIN EXCLUSIVE`); err != nil {
+		t.Fatal(err)
+	}
+	return db, lock
+}
+
+// A write that finds the database locked is retried, and lands once the lock
+// is released within the retries.
+func TestExecRetryWaitsOutLock(t *testing.T) {
+	db, lock := lockedDB(t)
+	s := &chatServer{db: db}
+	if _, err := db.Exec(`INSERT INTO t(x) VALUES(0)`); err == nil || !isBusy(err) {
+		t.Fatalf("plain insert under the lock: got %v, want busy", err)
+	}
+	const hold = 80 * time.Millisecond
+	go func() {
+		time.Sleep(hold)
+		_, _ = lock.ExecContext(context.Background(), `COMMIT`)
+	}()
+	start := time.Now()
+	if _, err := s.execRetry(`INSERT INTO t(x) VALUES(1)`); err != nil {
+		t.Fatalf("execRetry: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < hold {
+		t.Fatalf("execRetry returned after %s, before the lock was released", elapsed)
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM t WHERE x=1`).Scan(&n); err != nil || n != 1 {
+		t.Fatalf("row count %d, %v; want 1", n, err)
+	}
+}
+
+// A lock held past every retry gives up with errDBBusy.
+func TestExecRetryGivesUp(t *testing.T) {
+	db, _ := lockedDB(t)
+	s := &chatServer{db: db}
+	if _, err := s.execRetry(`INSERT INTO t(x) VALUES(1)`); !errors.Is(err, errDBBusy) {
+		t.Fatalf("execRetry: got %v, want errDBBusy", err)
+	}
+}
+
+// addUser creates username with password, hashed cheaply for tests.
+func addUser(t *testing.T, s *chatServer, username, password string) {
+	t.Helper()
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO users(username, password_hash) VALUES(?,?)`, username, h); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// dial connects to the server on ln and logs in.
+func dial(t *testing.T, ln net.Listener, username, password string) *pipeClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newPipeClient(t, conn)
+	c.send(t, "login "+username+" "+password)
+	waitOutput(t, c, "Logged in as "+username)
+	return c
+}
+
+func (c *pipeClient) send(t *testing.T, line string) {
+	t.Helper()
+	if _, err := fmt.Fprintf(c.conn, "%s\n", line); err != nil {
+		t.Fatalf("send %q: %v", line, err)
+	}
+}
+
+// An in-process server on an ephemeral port: login, live messaging, delivery
+// of what was sent while the peer was away, and serve returning once the
+// listener closes.
+func TestServeEndToEnd(t *testing.T) {
+	s := newTestServer(t, options{})
+	addUser(t, s, "bilal", "pw-bilal")
+	addUser(t, s, "zohaib", "pw zohaib")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.serve(ln) }()
+
+	bilal := dial(t, ln, "bilal", "pw-bilal")
+	zohaib := dial(t, ln, "zohaib", "pw zohaib")
+	bilal.send(t, "hello there")
+	waitOutput(t, zohaib, "bilal: hello there")
+
+	zohaib.send(t, "/quit")
+	waitOutput(t, bilal, "zohaib left")
+	bilal.send(t, "are you back?")
+	waitOutput(t, bilal, "offline")
+	zohaib = dial(t, ln, "zohaib", "pw zohaib")
+	waitOutput(t, zohaib, "You had 1 offline message(s).", "are you back?")
+
+	ln.Close()
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("serve returned %v, want net.ErrClosed", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("serve didn't return after its listener closed")
+	}
+}
+
+// A message that couldn't be stored isn't the "previous message" for
+// duplicate suppression, so sending it again goes through.
+func TestDuplicateAfterFailedSend(t *testing.T) {
+	s := newTestServer(t, options{dedupWindow: time.Minute, maxQueued: 1})
+	session(t, s, "bilal")
+	if _, err := s.sendToPeer("bilal", "first", msgOpts{}); !errors.Is(err, errPeerOffline) {
+		t.Fatalf("first: got %v, want errPeerOffline", err)
+	}
+	if _, err := s.sendToPeer("bilal", "again", msgOpts{}); !errors.Is(err, errInboxFull) {
+		t.Fatalf("again, inbox full: got %v, want errInboxFull", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM messages`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sendToPeer("bilal", "again", msgOpts{}); !errors.Is(err, errPeerOffline) {
+		t.Fatalf("again, after room was made: got %v, want errPeerOffline", err)
+	}
+	if _, err := s.sendToPeer("bilal", "again", msgOpts{}); !errors.Is(err, errDuplicate) {
+		t.Fatalf("again, once stored: got %v, want errDuplicate", err)
+	}
+}
+
+// A send refused after the slow-mode check (here by a full inbox) doesn't
+// start the interval; only a stored message does.
+func TestSlowModeAfterFailedSend(t *testing.T) {
+	s := newTestServer(t, options{maxQueued: 1})
+	session(t, s, "bilal")
+	s.mu.Lock()
+	s.slowMode = time.Hour
+	s.mu.Unlock()
+	if _, err := s.db.Exec(`INSERT INTO messages(sender, recipient, text, ts, delivered) VALUES('bilal', 'zohaib', 'queued', ?, 0)`, time.Now().UTC().Format(dbTimeLayout)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sendToPeer("bilal", "first", msgOpts{}); !errors.Is(err, errInboxFull) {
+		t.Fatalf("first, inbox full: got %v, want errInboxFull", err)
+	}
+	if _, err := s.db.Exec(`DELETE FROM messages`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.sendToPeer("bilal", "first", msgOpts{}); !errors.Is(err, errPeerOffline) {
+		t.Fatalf("first, after room was made: got %v, want errPeerOffline", err)
+	}
+	if _, err := s.sendToPeer("bilal", "second", msgOpts{}); !errors.Is(err, errSlowMode) {
+		t.Fatalf("second, once the first was stored: got %v, want errSlowMode", err)
+	}
+}
+
+// Live deliveries advance read marks with the delivered batch, not one
+// UPDATE per message.
+func TestReadMarkAdvancedPerBatch(t *testing.T) {
+	s := newTestServer(t, options{deliveredWindow: time.Hour, deliveredBatch: 100})
+	session(t, s, "bilal")
+	session(t, s, "zohaib")
+	if _, err := s.db.Exec(`INSERT INTO read_marks(user, msg_id) VALUES('zohaib', 0)`); err != nil {
+		t.Fatal(err)
+	}
+	mark := func() (id int64) {
+		if err := s.db.QueryRow(`SELECT msg_id FROM read_marks WHERE user='zohaib'`).Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	var last int64
+	for _, text := range []string{"one", "two", "three"} {
+		id, err := s.sendToPeer("bilal", text, msgOpts{})
+		if err != nil {
+			t.Fatalf("send %q: %v", text, err)
+		}
+		last = id
+	}
+	if got := mark(); got != 0 {
+		t.Fatalf("mark before the batch was flushed: got %d, want 0", got)
+	}
+	s.flushDelivered()
+	if got := mark(); got != last {
+		t.Fatalf("mark after the flush: got %d, want %d", got, last)
+	}
+}
+
+// login_audit keeps the last -login-audit-keep attempts plus each user's last
+// successful login, however many failures came after it.
+func TestLoginAuditPruned(t *testing.T) {
+	s := newTestServer(t, options{auditKeep: 3})
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	s.auditLogin("bilal", addr, true)
+	s.auditLogin("bilal", addr, true)
+	for i := 0; i < 5; i++ {
+		s.auditLogin("zohaib", addr, false)
+	}
+	rows, err := s.db.Query(`SELECT rowid, username, success FROM login_audit ORDER BY rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var got []string
+	for rows.Next() {
+		var id int
+		var u string
+		var ok bool
+		if err := rows.Scan(&id, &u, &ok); err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, fmt.Sprintf("%d %s %v", id, u, ok))
+	}
+	want := []string{"2 bilal true", "5 zohaib false", "6 zohaib false", "7 zohaib false"}
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("login_audit rows: got %v, want %v", got, want)
+	}
+}
+
+// Deleting an account from one session disconnects the user's others, so
+// none is left sending as a user who no longer exists.
+func TestDeleteAccountClosesOtherSessions(t *testing.T) {
+	s := newTestServer(t, options{})
+	addUser(t, s, "bilal", "pw-bilal")
+	addUser(t, s, "zohaib", "pw-zohaib")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve(ln)
+
+	bilal := dial(t, ln, "bilal", "pw-bilal")
+	phone := dial(t, ln, "zohaib", "pw-zohaib")
+	laptop := dial(t, ln, "zohaib", "pw-zohaib")
+	laptop.send(t, "/delete-account pw-zohaib")
+	waitOutput(t, laptop, "keep")
+	laptop.send(t, "purge")
+	waitOutput(t, laptop, "Account deleted. Goodbye.")
+	waitOutput(t, phone, "Your account was deleted from another session.")
+	for _, c := range []*pipeClient{phone, laptop} {
+		select {
+		case <-c.done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("a session of the deleted account is still connected")
+		}
+	}
+	waitOutput(t, bilal, "zohaib left.")
+	time.Sleep(100 * time.Millisecond)
+	bilal.mu.Lock()
+	left := strings.Count(bilal.out.String(), "zohaib left.")
+	bilal.mu.Unlock()
+	if left != 1 {
+		t.Fatalf("bilal was told %d times that zohaib left, want once", left)
+	}
+	if cs := s.sessions("zohaib"); len(cs) != 0 {
+		t.Fatalf("%d session(s) still attached for the deleted account", len(cs))
+	}
+}
+
+// A reseed from file doesn't bring back an account deleted with
+// /delete-account.
+func TestSeedFromFileSkipsDeleted(t *testing.T) {
+	s := newTestServer(t, options{})
+	addUser(t, s, "zohaib", "pw-zohaib")
+	if err := s.deleteAccount("zohaib", false); err != nil {
+		t.Fatal(err)
+	}
+	n, err := seedFromFile(s.db, []seedUser{{Username: "zohaib", PasswordHash: "$2a$04$x"}, {Username: "bilal", PasswordHash: "$2a$04$y"}}, true)
+	if err != nil || n != 1 {
+		t.Fatalf("seedFromFile: %d changed, %v; want 1 (bilal only)", n, err)
+	}
+	var exists int
+	_ = s.db.QueryRow(`SELECT 1 FROM users WHERE username='zohaib'`).Scan(&exists)
+	if exists == 1 {
+		t.Fatal("the deleted account was re-created")
+	}
+}
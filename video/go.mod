@@ -3,3 +3,9 @@ module chatvideo
 go 1.22
 
 require github.com/gorilla/websocket v1.5.3
+
+require (
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+)
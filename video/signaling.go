@@ -1,17 +1,30 @@
 package main
 
 import (
+	"crypto/subtle"
 	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html"
+	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/acme/autocert"
 )
 
-// Embed the web/ directory containing send.html & view.html
+// Embed the web/ directory containing send.html, view.html & call.html
 //go:embed web
 var webFS embed.FS
 
@@ -31,55 +44,205 @@ type endpoint struct {
 	answer        *string             // last SDP answer from viewer
 	iceFromSender []json.RawMessage   // ICE candidates to send to viewer
 	iceFromViewer []json.RawMessage   // ICE candidates to send to sender
+
+	// a reloaded tab has a new RTCPeerConnection, so SDP sent to or from the old
+	// one is useless to it: offered records that a viewer already took an offer,
+	// and a viewer rejoining after that asks the sender for a fresh one
+	offered                bool
+	senderLeft, viewerLeft time.Time // when that role's connection dropped
+
+	// symmetric roles: two slots, either may offer. "peer" (e.g. a data
+	// channel) takes whichever slot is free; "caller" and "callee" (two-way
+	// audio/video) always take slots 0 and 1, so a reconnect reclaims its own.
+	peers     [2]*websocket.Conn
+	peerQueue [2][]msg // sent by peers[i] before the other slot attached
+	// caller/callee slot has been taken before, so taking it again is a
+	// reloaded tab and both sides negotiate afresh
+	peerJoined [2]bool
+
+	idleSince time.Time // when the last connection left; zero while any is attached
 }
 
 type server struct {
-	mu       sync.Mutex
-	sessions map[string]*endpoint // sid -> endpoint
+	mu          sync.Mutex
+	sessions    map[sessionKey]*endpoint
+	maxSessions int           // MAX_SESSIONS; new sids are refused beyond it
+	rejoinGrace time.Duration // -rejoin-grace; 0 = never ask a sender to renegotiate
+	debug       bool          // -debug: accept the "echo" diagnostic role
+	limiter     *ipLimiter    // -upgrade-rate per client IP; nil = unlimited
+	trusted     []*net.IPNet  // -trusted-proxies whose X-Forwarded-For is believed
+
+	// counters for /metrics
+	created, upgrades, throttled, offers, answers, ice, dropped atomic.Int64
 }
 
+// maxFrame is the largest signaling message accepted; SDP is a few KB.
+// A bigger frame is counted as dropped and closes the connection.
+const maxFrame = 64 << 10
+
+// sessionIdleTTL is how long a session with nobody attached keeps its queued
+// state before the sweeper forgets it, so abandoned sids don't count against
+// MAX_SESSIONS forever.
+const sessionIdleTTL = 10 * time.Minute
+
+// writeWait bounds each relay or replay write. They happen under ep.mu, so a
+// peer that stops reading would otherwise stall its whole session.
+const writeWait = 5 * time.Second
+
 func main() {
-	s := &server{sessions: make(map[string]*endpoint)}
+	addr := flag.String("addr", ":5001", "listen address for /ws, /end and /metrics, and the pages unless -static-addr is set")
+	staticAddr := flag.String("static-addr", "", "serve the /v/ pages on this address instead of -addr")
+	noStatic := flag.Bool("no-static", false, "don't serve the /v/ pages at all, e.g. when a CDN hosts them")
+	debug := flag.Bool("debug", false, "accept hello role \"echo\", which sends every frame straight back, to test the WebSocket path without cameras")
+	upgradeRate := flag.Float64("upgrade-rate", 2, "WebSocket upgrades allowed per second from one IP, refilling a bucket of -upgrade-burst (0 for no limit)")
+	upgradeBurst := flag.Int("upgrade-burst", 10, "upgrades one IP may make at once before -upgrade-rate applies")
+	trustedProxies := flag.String("trusted-proxies", "", "comma-separated IPs or CIDRs of reverse proxies whose X-Forwarded-For names the client")
+	wsAllow := flag.String("ws-allow", "", "comma-separated signaling origins (e.g. wss://signal.example.com) the pages may be sent to with ?ws=, besides their own host")
+	rejoinGrace := flag.Duration("rejoin-grace", 30*time.Second, "ask the connected sender for a fresh offer when a viewer reconnects within this long (0 to disable)")
+	flag.Parse()
 
-	// Serve embedded /v/* pages from web/
-	sub, err := fs.Sub(webFS, "web")
+	maxSessions := 1000
+	if v := os.Getenv("MAX_SESSIONS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			log.Fatalf("MAX_SESSIONS: want a positive integer, got %q", v)
+		}
+		maxSessions = n
+	}
+	trusted, err := parseNets(*trustedProxies)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("-trusted-proxies: %v", err)
 	}
-	http.Handle("/v/", http.StripPrefix("/v/", http.FileServer(http.FS(sub))))
+	s := &server{sessions: make(map[sessionKey]*endpoint), maxSessions: maxSessions, rejoinGrace: *rejoinGrace, debug: *debug, trusted: trusted}
+	if *upgradeRate > 0 {
+		s.limiter = newIPLimiter(*upgradeRate, max(*upgradeBurst, 1))
+	}
+	go s.sweep()
 
-	// Nice redirects without .html (optional)
-	http.HandleFunc("/v/send", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/v/send.html?"+r.URL.RawQuery, http.StatusFound)
-	})
-	http.HandleFunc("/v/view", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/v/view.html?"+r.URL.RawQuery, http.StatusFound)
-	})
+	// Serve embedded /v/* pages from web/, on -static-addr if set. The pages
+	// accept ?ws= to reach /ws on another host, e.g. when they're on a CDN, but
+	// only for origins in -ws-allow (or their own host).
+	api := http.NewServeMux()
+	pages := api
+	if *staticAddr != "" {
+		pages = http.NewServeMux()
+	}
+	if !*noStatic {
+		if err := servePages(pages, *wsAllow); err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// WebSocket signaling
-	http.HandleFunc("/ws", s.ws)
+	api.HandleFunc("/ws", s.ws)
+	// Called by the chat server when a participant leaves
+	api.HandleFunc("/end", s.end)
+	// Asked by the chat server whether a session is still in use
+	api.HandleFunc("/active", s.active)
+	if os.Getenv("VIDEO_END_TOKEN") == "" {
+		log.Println("VIDEO_END_TOKEN is unset: /end and /active refuse every request, so the chat server can't close or check calls")
+	}
+	// Prometheus text-format gauges and counters
+	api.HandleFunc("/metrics", s.metrics)
+
+	if *staticAddr != "" && !*noStatic {
+		go func() {
+			log.Println("Video pages listening on", *staticAddr)
+			log.Fatal(http.ListenAndServe(*staticAddr, pages))
+		}()
+	}
+
+	// With VIDEO_DOMAIN set (comma-separated for several names), serve HTTPS on :443
+	// using Let's Encrypt certificates picked by SNI, and redirect :80 to HTTPS.
+	if domains := os.Getenv("VIDEO_DOMAIN"); domains != "" {
+		cacheDir := os.Getenv("VIDEO_CERT_DIR")
+		if cacheDir == "" {
+			cacheDir = "certs"
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(strings.Split(domains, ",")...),
+			Cache:      autocert.DirCache(cacheDir),
+		}
+		// :80 answers ACME http-01 challenges and redirects everything else
+		go func() { log.Fatal(http.ListenAndServe(":80", m.HTTPHandler(nil))) }()
+
+		srv := &http.Server{Addr: ":443", Handler: api, TLSConfig: m.TLSConfig()}
+		log.Println("Video signaling listening on :443 for", domains)
+		log.Fatal(srv.ListenAndServeTLS("", ""))
+	}
+
+	log.Println("Video signaling listening on", *addr)
+	log.Fatal(http.ListenAndServe(*addr, api))
+}
 
-	addr := ":5001"
-	log.Println("Video signaling listening on", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+// wsAllowMeta is the tag in each page that lists the origins ?ws= may name.
+const wsAllowMeta = `<meta name="video-ws-allow" content="" />`
+
+// servePages registers the embedded pages and their extensionless redirects.
+// HTML pages get allow (-ws-allow) filled into their video-ws-allow tag.
+func servePages(mux *http.ServeMux, allow string) error {
+	sub, err := fs.Sub(webFS, "web")
+	if err != nil {
+		return err
+	}
+	files := http.FileServer(http.FS(sub))
+	filled := `<meta name="video-ws-allow" content="` + html.EscapeString(allow) + `" />`
+	mux.Handle("/v/", http.StripPrefix("/v/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, ".html") {
+			files.ServeHTTP(w, r)
+			return
+		}
+		page, err := fs.ReadFile(sub, r.URL.Path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = io.WriteString(w, strings.Replace(string(page), wsAllowMeta, filled, 1))
+	})))
+
+	// Nice redirects without .html (optional)
+	for _, page := range []string{"send", "view", "call"} {
+		target := "/v/" + page + ".html?"
+		mux.HandleFunc("/v/"+page, func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, target+r.URL.RawQuery, http.StatusFound)
+		})
+	}
+	return nil
 }
 
 type hello struct {
-	Role string `json:"role"` // "sender" or "viewer"
-	SID  string `json:"sid"`
+	Role     string `json:"role"` // "sender", "viewer", "peer", "caller" or "callee"
+	SID      string `json:"sid"`
+	Instance string `json:"instance,omitempty"` // the chat server that issued sid, if several share this one
+}
+
+// sessionKey identifies a session. SIDs are only unique per chat server, so
+// they're namespaced by the instance that issued them; "" is a server that
+// doesn't say.
+type sessionKey struct {
+	instance, sid string
 }
 
 type msg struct {
-	Type string          `json:"type"`                // "offer", "answer", "ice"
+	Type string          `json:"type"`                // "offer", "answer", "ice"; "restart" is only sent, to a sender
 	SDP  string          `json:"sdp,omitempty"`       // for offer/answer
 	Cand json.RawMessage `json:"candidate,omitempty"` // for ice
 }
 
 func (s *server) ws(w http.ResponseWriter, r *http.Request) {
+	if ip := s.clientIP(r); !s.limiter.allow(ip) {
+		s.throttled.Add(1)
+		http.Error(w, "too many connections, slow down", http.StatusTooManyRequests)
+		return
+	}
 	c, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
 	}
+	s.upgrades.Add(1)
+	c.SetReadLimit(maxFrame)
 
 	// First message must be hello {role,sid}
 	_, data, err := c.ReadMessage()
@@ -88,55 +251,99 @@ func (s *server) ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	var hi hello
-	if err := json.Unmarshal(data, &hi); err != nil || (hi.Role != "sender" && hi.Role != "viewer") || hi.SID == "" {
+	err = json.Unmarshal(data, &hi)
+	if err == nil && hi.Role == "echo" && s.debug {
+		echo(c)
+		return
+	}
+	if err != nil || !validRole(hi.Role) || hi.SID == "" {
 		_ = c.Close()
 		return
 	}
 
-	ep := s.getOrCreate(hi.SID)
+	ep := s.getOrCreate(sessionKey{hi.Instance, hi.SID})
+	if ep == nil {
+		log.Printf("refusing sid %q (instance %q): %d sessions open (MAX_SESSIONS)", hi.SID, hi.Instance, s.maxSessions)
+		_ = c.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "too many sessions"), time.Now().Add(time.Second))
+		_ = c.Close()
+		return
+	}
 
-	// Attach this connection
+	// Attach this connection. Replaying queued state happens under ep.mu, and the
+	// counterpart's relay loop takes ep.mu per frame, so anything it sends is
+	// either already queued (and replayed here first) or relayed live after.
 	ep.mu.Lock()
-	if hi.Role == "sender" {
+	ep.idleSince = time.Time{}
+	slot := -1 // peers[] index for the symmetric roles
+	switch hi.Role {
+	case "sender":
+		if ep.sender != nil || !ep.senderLeft.IsZero() {
+			// a new tab offers afresh; anything from or for the old one is stale
+			ep.offer, ep.iceFromSender = nil, nil
+			ep.answer, ep.iceFromViewer = nil, nil
+			ep.offered = false
+		}
 		if ep.sender != nil {
 			_ = ep.sender.Close()
 		}
 		ep.sender = c
-		// If viewer already sent an answer or ICE, deliver them now
-		if ep.answer != nil {
-			_ = ep.sender.WriteJSON(msg{Type: "answer", SDP: *ep.answer})
-			ep.answer = nil
+		ep.replay(hi.Role, c)
+	case "viewer":
+		rejoin := ep.viewer != nil || !ep.viewerLeft.IsZero()
+		renegotiate := rejoin && ep.offered && ep.offer == nil && s.rejoinGrace > 0 && (ep.viewer != nil || s.withinGrace(ep.viewerLeft))
+		if rejoin {
+			ep.answer, ep.iceFromViewer = nil, nil // the old tab's, for a connection that's gone
 		}
-		for _, cand := range ep.iceFromViewer {
-			_ = ep.sender.WriteJSON(msg{Type: "ice", Cand: cand})
-		}
-		ep.iceFromViewer = nil
-	} else { // viewer
 		if ep.viewer != nil {
 			_ = ep.viewer.Close()
 		}
 		ep.viewer = c
-		// If sender already sent an offer or ICE, deliver them now
-		if ep.offer != nil {
-			_ = ep.viewer.WriteJSON(msg{Type: "offer", SDP: *ep.offer})
-			ep.offer = nil
+		if renegotiate {
+			ep.restartSender()
+		}
+		ep.replay(hi.Role, c)
+	case "caller", "callee":
+		slot = 0
+		if hi.Role == "callee" {
+			slot = 1
+		}
+		if ep.peers[slot] != nil {
+			_ = ep.peers[slot].Close()
 		}
-		for _, cand := range ep.iceFromSender {
-			_ = ep.viewer.WriteJSON(msg{Type: "ice", Cand: cand})
+		if ep.peerJoined[slot] {
+			// whatever either side queued belongs to the old tab's negotiation
+			ep.peerQueue = [2][]msg{}
+			ep.restartPeer(1 - slot)
+		}
+		ep.peerJoined[slot] = true
+		ep.attachPeer(c, slot)
+	case "peer":
+		if slot = ep.attachPeer(c, -1); slot < 0 {
+			ep.mu.Unlock()
+			_ = c.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session already has two peers"), time.Now().Add(time.Second))
+			_ = c.Close()
+			return
 		}
-		ep.iceFromSender = nil
 	}
 	ep.mu.Unlock()
 
 	// Relay loop
-	go func(role, sid string, conn *websocket.Conn) {
+	go func(role, sid string, slot int, conn *websocket.Conn) {
 		defer func() {
 			ep.mu.Lock()
 			if role == "sender" && ep.sender == conn {
-				ep.sender = nil
+				ep.sender, ep.senderLeft = nil, time.Now()
 			}
 			if role == "viewer" && ep.viewer == conn {
-				ep.viewer = nil
+				ep.viewer, ep.viewerLeft = nil, time.Now()
+			}
+			if slot >= 0 && ep.peers[slot] == conn {
+				ep.peers[slot] = nil
+			}
+			if ep.idle() && ep.idleSince.IsZero() {
+				ep.idleSince = time.Now()
 			}
 			ep.mu.Unlock()
 			_ = conn.Close()
@@ -145,66 +352,511 @@ func (s *server) ws(w http.ResponseWriter, r *http.Request) {
 		for {
 			var m msg
 			if err := conn.ReadJSON(&m); err != nil {
+				if errors.Is(err, websocket.ErrReadLimit) {
+					s.dropped.Add(1)
+				}
 				return
 			}
 
 			ep.mu.Lock()
-			var dst *websocket.Conn
-			if role == "sender" {
-				dst = ep.viewer
+			var ok bool
+			if slot >= 0 {
+				ok = ep.forwardPeer(slot, m)
 			} else {
-				dst = ep.sender
+				ok = ep.forward(role, m)
+			}
+			ep.mu.Unlock()
+			if ok {
+				s.count(m.Type)
 			}
+		}
+	}(hi.Role, hi.SID, slot, c)
+}
 
-			switch m.Type {
-			case "offer":
-				// only valid from sender -> viewer
-				if role == "sender" {
-					if dst != nil {
-						_ = dst.WriteJSON(m)
-					} else {
-						// queue until viewer attaches
-						cp := m.SDP
-						ep.offer = &cp
-					}
-				}
-			case "answer":
-				// only valid from viewer -> sender
-				if role == "viewer" {
-					if dst != nil {
-						_ = dst.WriteJSON(m)
-					} else {
-						// queue until sender attaches
-						cp := m.SDP
-						ep.answer = &cp
-					}
-				}
-			case "ice":
-				if dst != nil {
-					_ = dst.WriteJSON(m)
-				} else {
-					// queue ICE depending on direction
-					if role == "sender" {
-						ep.iceFromSender = append(ep.iceFromSender, m.Cand)
-					} else {
-						ep.iceFromViewer = append(ep.iceFromViewer, m.Cand)
-					}
-				}
-			default:
-				// ignore
+// forward relays m from role to the other side, or queues it until that side
+// attaches. A failed write drops the dead connection and queues the message
+// instead, so nothing is lost between a peer dropping and reattaching.
+// It reports false for messages it ignores. Callers hold ep.mu.
+func (ep *endpoint) forward(role string, m msg) bool {
+	switch m.Type {
+	case "offer": // only valid from sender -> viewer
+		if role != "sender" {
+			return false
+		}
+	case "answer": // only valid from viewer -> sender
+		if role != "viewer" {
+			return false
+		}
+	case "ice":
+	default:
+		return false // ignore
+	}
+
+	dst := &ep.viewer
+	if role == "viewer" {
+		dst = &ep.sender
+	}
+	if *dst != nil {
+		if err := writeMsg(*dst, m); err == nil {
+			if m.Type == "offer" {
+				ep.offered = true
 			}
-			ep.mu.Unlock()
+			return true
+		}
+		_ = (*dst).Close()
+		*dst = nil
+	}
+
+	switch m.Type {
+	case "offer":
+		cp := m.SDP
+		ep.offer = &cp
+	case "answer":
+		cp := m.SDP
+		ep.answer = &cp
+	case "ice":
+		if role == "sender" {
+			ep.iceFromSender = append(ep.iceFromSender, m.Cand)
+		} else {
+			ep.iceFromViewer = append(ep.iceFromViewer, m.Cand)
+		}
+	}
+	return true
+}
+
+// replay delivers what the counterpart queued before role attached as c: the
+// SDP first, then ICE in arrival order. Each item leaves the queue only once
+// written, so a failed write keeps the rest for the next attach. SDP already
+// delivered to an earlier tab is never replayed: it belongs to that tab's
+// RTCPeerConnection. Callers hold ep.mu.
+func (ep *endpoint) replay(role string, c *websocket.Conn) {
+	sdp, ice, typ := &ep.offer, &ep.iceFromSender, "offer"
+	if role == "sender" {
+		sdp, ice, typ = &ep.answer, &ep.iceFromViewer, "answer"
+	}
+	if *sdp != nil {
+		if err := writeMsg(c, msg{Type: typ, SDP: **sdp}); err != nil {
+			return
+		}
+		*sdp = nil
+		if typ == "offer" {
+			ep.offered = true
+		}
+	}
+	for len(*ice) > 0 {
+		if err := writeMsg(c, msg{Type: "ice", Cand: (*ice)[0]}); err != nil {
+			return
+		}
+		*ice = (*ice)[1:]
+	}
+	*ice = nil
+}
+
+// restartSender asks the attached sender for a fresh offer, for a viewer whose
+// earlier tab took the last one. The sender's ICE still queued for that tab is
+// dropped; send.html rebuilds its RTCPeerConnection on "restart". A sender
+// that isn't attached will offer anyway when its new tab connects.
+// Callers hold ep.mu.
+func (ep *endpoint) restartSender() {
+	ep.offered, ep.iceFromSender = false, nil
+	if ep.sender == nil {
+		return
+	}
+	if err := writeMsg(ep.sender, msg{Type: "restart"}); err != nil {
+		_ = ep.sender.Close()
+		ep.sender = nil
+	}
+}
+
+// restartPeer asks the call participant in slot for a fresh negotiation,
+// because the other side's tab was reloaded; call.html rebuilds its
+// RTCPeerConnection on "restart", and the caller offers again.
+// Callers hold ep.mu.
+func (ep *endpoint) restartPeer(slot int) {
+	if ep.peers[slot] == nil {
+		return
+	}
+	if err := writeMsg(ep.peers[slot], msg{Type: "restart"}); err != nil {
+		_ = ep.peers[slot].Close()
+		ep.peers[slot] = nil
+	}
+}
+
+// writeMsg writes m to c, giving up after writeWait.
+func writeMsg(c *websocket.Conn, m msg) error {
+	_ = c.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.WriteJSON(m)
+}
+
+// withinGrace reports whether a role that left at left may still rejoin.
+func (s *server) withinGrace(left time.Time) bool {
+	return !left.IsZero() && time.Since(left) <= s.rejoinGrace
+}
+
+// echo is the -debug "echo" role: every frame goes straight back to c, so
+// a developer can check the WebSocket path without a second browser. It needs
+// no sid and never touches a session.
+func echo(c *websocket.Conn) {
+	defer c.Close()
+	for {
+		typ, data, err := c.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := c.WriteMessage(typ, data); err != nil {
+			return
+		}
+	}
+}
+
+// validRole reports whether a hello's role is one ws knows how to relay for.
+func validRole(role string) bool {
+	switch role {
+	case "sender", "viewer", "peer", "caller", "callee":
+		return true
+	}
+	return false
+}
+
+// attachPeer puts c in peer slot slot, or with slot -1 in a free one, and
+// replays what the other slot sent while it was alone. It returns the slot,
+// or -1 if slot was -1 and both are taken. Callers hold ep.mu.
+func (ep *endpoint) attachPeer(c *websocket.Conn, slot int) int {
+	for i, p := range ep.peers {
+		if slot >= 0 {
+			break
+		}
+		if p == nil {
+			slot = i
+		}
+	}
+	if slot < 0 {
+		return -1
+	}
+	ep.peers[slot] = c
+	q := &ep.peerQueue[1-slot]
+	for len(*q) > 0 {
+		if err := writeMsg(c, (*q)[0]); err != nil {
+			break
+		}
+		*q = (*q)[1:]
+	}
+	return slot
+}
+
+// forwardPeer relays offer/answer/ice between the two peer slots in either
+// direction, queueing while the other slot is empty or its write fails. Both
+// sides may send media, so neither offers nor answers are tied to a slot.
+// It reports false for messages it ignores. Callers hold ep.mu.
+func (ep *endpoint) forwardPeer(slot int, m msg) bool {
+	if m.Type != "offer" && m.Type != "answer" && m.Type != "ice" {
+		return false // ignore
+	}
+	if dst := ep.peers[1-slot]; dst != nil {
+		if err := writeMsg(dst, m); err == nil {
+			return true
+		}
+		_ = dst.Close()
+		ep.peers[1-slot] = nil
+	}
+	ep.peerQueue[slot] = append(ep.peerQueue[slot], m)
+	return true
+}
+
+func (s *server) count(typ string) {
+	switch typ {
+	case "offer":
+		s.offers.Add(1)
+	case "answer":
+		s.answers.Add(1)
+	case "ice":
+		s.ice.Add(1)
+	}
+}
+
+// metrics serves session gauges and relay counters in the Prometheus text format.
+func (s *server) metrics(w http.ResponseWriter, r *http.Request) {
+	// never hold s.mu while waiting on an ep.mu: a relay write can keep
+	// that busy for up to writeWait
+	s.mu.Lock()
+	eps := make([]*endpoint, 0, len(s.sessions))
+	for _, ep := range s.sessions {
+		eps = append(eps, ep)
+	}
+	s.mu.Unlock()
+
+	var active, withSender, withViewer int
+	for _, ep := range eps {
+		ep.mu.Lock()
+		if !ep.idle() {
+			active++
+		}
+		if ep.sender != nil {
+			withSender++
+		}
+		if ep.viewer != nil {
+			withViewer++
+		}
+		ep.mu.Unlock()
+	}
+	total := len(eps)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metric := func(name, typ, help string, v int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, typ, name, v)
+	}
+	metric("video_sessions", "gauge", "Sessions known, including idle ones keeping queued state.", int64(total))
+	metric("video_active_sessions", "gauge", "Sessions with at least one connection attached.", int64(active))
+	metric("video_sessions_with_sender", "gauge", "Sessions with a sender attached.", int64(withSender))
+	metric("video_sessions_with_viewer", "gauge", "Sessions with a viewer attached.", int64(withViewer))
+	metric("video_sessions_created_total", "counter", "Sessions created by a first hello for a new sid.", s.created.Load())
+	metric("video_upgrades_total", "counter", "WebSocket upgrades on /ws.", s.upgrades.Load())
+	metric("video_throttled_upgrades_total", "counter", "Upgrades refused with 429 by the per-IP rate limit.", s.throttled.Load())
+	metric("video_relayed_offers_total", "counter", "SDP offers relayed or queued.", s.offers.Load())
+	metric("video_relayed_answers_total", "counter", "SDP answers relayed or queued.", s.answers.Load())
+	metric("video_relayed_ice_total", "counter", "ICE candidates relayed or queued.", s.ice.Load())
+	metric("video_dropped_frames_total", "counter", "Frames over the size limit; each closes its connection.", s.dropped.Load())
+}
+
+// end closes both sides of a session so each browser sees its WebSocket close,
+// then forgets the session named by ?sid= and ?instance=. The caller must
+// present VIDEO_END_TOKEN; with it unset /end is refused, since anyone who can
+// reach the server could otherwise hang up any call.
+func (s *server) end(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !chatAuthorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	key := sessionKey{r.URL.Query().Get("instance"), r.URL.Query().Get("sid")}
+	s.mu.Lock()
+	ep := s.sessions[key]
+	delete(s.sessions, key)
+	s.mu.Unlock()
+	if ep == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	ep.mu.Lock()
+	bye := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "peer left")
+	for _, c := range []*websocket.Conn{ep.sender, ep.viewer, ep.peers[0], ep.peers[1]} {
+		if c != nil {
+			_ = c.WriteControl(websocket.CloseMessage, bye, time.Now().Add(time.Second))
+			_ = c.Close()
 		}
-	}(hi.Role, hi.SID, c)
+	}
+	ep.sender, ep.viewer = nil, nil
+	ep.peers = [2]*websocket.Conn{}
+	ep.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
 }
 
-func (s *server) getOrCreate(sid string) *endpoint {
+// active answers 204 while the session named by ?sid= and ?instance= has a
+// connection attached and 404 otherwise, so the chat server can stop counting
+// calls whose tabs have closed against -max-video-sessions. It takes the same
+// VIDEO_END_TOKEN as /end.
+func (s *server) active(w http.ResponseWriter, r *http.Request) {
+	if !chatAuthorized(r) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	s.mu.Lock()
+	ep := s.sessions[sessionKey{r.URL.Query().Get("instance"), r.URL.Query().Get("sid")}]
+	s.mu.Unlock()
+	if ep != nil {
+		ep.mu.Lock()
+		live := !ep.idle()
+		ep.mu.Unlock()
+		if live {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// chatAuthorized reports whether r carries VIDEO_END_TOKEN, which /end and
+// /active require; with no token configured nothing is authorized.
+func chatAuthorized(r *http.Request) bool {
+	tok := os.Getenv("VIDEO_END_TOKEN")
+	return tok != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+tok)) == 1
+}
+
+// getOrCreate returns the session for key, creating it if there's room.
+// It returns nil when key is new and maxSessions are already open.
+func (s *server) getOrCreate(key sessionKey) *endpoint {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	ep := s.sessions[sid]
+	ep := s.sessions[key]
 	if ep == nil {
+		if len(s.sessions) >= s.maxSessions {
+			return nil
+		}
 		ep = &endpoint{}
-		s.sessions[sid] = ep
+		s.sessions[key] = ep
+		s.created.Add(1)
 	}
 	return ep
 }
+
+// idle reports whether no connection is attached. Callers hold ep.mu.
+func (ep *endpoint) idle() bool {
+	return ep.sender == nil && ep.viewer == nil && ep.peers[0] == nil && ep.peers[1] == nil
+}
+
+// sweep periodically forgets sessions nobody has been attached to for
+// sessionIdleTTL, and rate-limit buckets that have refilled.
+func (s *server) sweep() {
+	for range time.Tick(time.Minute) {
+		s.limiter.prune()
+		// as in metrics, check each session without holding s.mu
+		s.mu.Lock()
+		eps := make(map[sessionKey]*endpoint, len(s.sessions))
+		for key, ep := range s.sessions {
+			eps[key] = ep
+		}
+		s.mu.Unlock()
+
+		var stale []sessionKey
+		for key, ep := range eps {
+			ep.mu.Lock()
+			if ep.idle() && !ep.idleSince.IsZero() && time.Since(ep.idleSince) > sessionIdleTTL {
+				stale = append(stale, key)
+			}
+			ep.mu.Unlock()
+		}
+
+		s.mu.Lock()
+		for _, key := range stale {
+			if s.sessions[key] == eps[key] { // not ended and recreated meanwhile
+				delete(s.sessions, key)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// ipLimiter is a token bucket per client IP: each holds up to burst tokens,
+// refills at rate per second, and an upgrade spends one.
+type ipLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newIPLimiter(rate float64, burst int) *ipLimiter {
+	return &ipLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow spends a token from ip's bucket, reporting false if it's empty.
+// A nil limiter allows everything.
+func (l *ipLimiter) allow(ip string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.buckets[ip]
+	if b == nil {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune forgets buckets that would be full by now, which behave the same as
+// no bucket at all.
+func (l *ipLimiter) prune() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// clientIP is the address the rate limit applies to: the peer's IP, or, when
+// the peer is a trusted proxy, the rightmost X-Forwarded-For entry that isn't
+// one (entries further left are client-supplied and can be forged).
+func (s *server) clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !s.isTrusted(ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if ip = hop; !s.isTrusted(hop) {
+			break
+		}
+	}
+	return ip
+}
+
+func (s *server) isTrusted(ip string) bool {
+	addr := net.ParseIP(ip)
+	for _, n := range s.trusted {
+		if addr != nil && n.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNets reads a comma-separated list of IPs and CIDRs; a bare IP is a
+// single-address network.
+func parseNets(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, f := range strings.Split(list, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, fmt.Errorf("bad address %q", f)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer runs s.ws on a local listener and returns the server and the
+// ws:// URL to dial.
+func newTestServer(t *testing.T) (*server, string) {
+	t.Helper()
+	s := &server{sessions: make(map[sessionKey]*endpoint), maxSessions: 10, rejoinGrace: time.Minute}
+	ts := httptest.NewServer(http.HandlerFunc(s.ws))
+	t.Cleanup(ts.Close)
+	return s, "ws" + strings.TrimPrefix(ts.URL, "http")
+}
+
+// client is a test connection whose incoming messages are read into in, since
+// a gorilla conn can't be read again after a read deadline expires.
+type client struct {
+	*websocket.Conn
+	in chan msg
+}
+
+// join dials url and says hello as role in session sid.
+func join(t *testing.T, url, role, sid string) *client {
+	t.Helper()
+	c, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	if err := c.WriteJSON(hello{Role: role, SID: sid}); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	cl := &client{Conn: c, in: make(chan msg, 64)}
+	go func() {
+		defer close(cl.in)
+		for {
+			var m msg
+			if err := c.ReadJSON(&m); err != nil {
+				return
+			}
+			cl.in <- m
+		}
+	}()
+	return cl
+}
+
+// waitFor polls cond on sid's endpoint, under its lock, until it holds.
+func waitFor(t *testing.T, s *server, sid string, what string, cond func(ep *endpoint) bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		ep := s.sessions[sessionKey{"", sid}]
+		s.mu.Unlock()
+		if ep != nil {
+			ep.mu.Lock()
+			ok := cond(ep)
+			ep.mu.Unlock()
+			if ok {
+				return
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting until %s", what)
+}
+
+func send(t *testing.T, c *client, m msg) {
+	t.Helper()
+	if err := c.WriteJSON(m); err != nil {
+		t.Fatalf("send %s: %v", m.Type, err)
+	}
+}
+
+// expect reads len(want) messages from c and compares them in order.
+func expect(t *testing.T, c *client, want ...msg) {
+	t.Helper()
+	for i, w := range want {
+		var got msg
+		select {
+		case m, ok := <-c.in:
+			if !ok {
+				t.Fatalf("message %d: want %s %q, connection closed", i, w.Type, w.SDP+string(w.Cand))
+			}
+			got = m
+		case <-time.After(2 * time.Second):
+			t.Fatalf("message %d: want %s %q, got nothing", i, w.Type, w.SDP+string(w.Cand))
+		}
+		if got.Type != w.Type || got.SDP != w.SDP || string(got.Cand) != string(w.Cand) {
+			t.Fatalf("message %d: want %s %q, got %s %q", i, w.Type, w.SDP+string(w.Cand), got.Type, got.SDP+string(got.Cand))
+		}
+	}
+}
+
+// expectNothing checks that c receives nothing for a short while.
+func expectNothing(t *testing.T, c *client) {
+	t.Helper()
+	select {
+	case got, ok := <-c.in:
+		if ok {
+			t.Fatalf("want nothing, got %s %q", got.Type, got.SDP+string(got.Cand))
+		}
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func cand(s string) json.RawMessage { return json.RawMessage(`"` + s + `"`) }
+
+// A viewer attaching while the sender trickles ICE gets the offer and then
+// every candidate exactly once, in the order sent: those queued before it
+// attached are replayed, the rest relayed live, with none lost or repeated at
+// the handoff.
+func TestLateViewerGetsEveryCandidateOnce(t *testing.T) {
+	const n = 50
+	for round := 0; round < 10; round++ {
+		s, url := newTestServer(t)
+		snd := join(t, url, "sender", "s1")
+		waitFor(t, s, "s1", "the sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+		send(t, snd, msg{Type: "offer", SDP: "O1"})
+		send(t, snd, msg{Type: "ice", Cand: cand("c0")})
+		waitFor(t, s, "s1", "the offer queued", func(ep *endpoint) bool { return ep.offer != nil && len(ep.iceFromSender) == 1 })
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1; i < n; i++ {
+				if err := snd.WriteJSON(msg{Type: "ice", Cand: cand(fmt.Sprintf("c%d", i))}); err != nil {
+					return
+				}
+				if i == n/4 {
+					time.Sleep(time.Millisecond) // let the viewer's hello land mid-trickle
+				}
+			}
+		}()
+		v := join(t, url, "viewer", "s1")
+		<-done
+
+		want := []msg{{Type: "offer", SDP: "O1"}}
+		for i := 0; i < n; i++ {
+			want = append(want, msg{Type: "ice", Cand: cand(fmt.Sprintf("c%d", i))})
+		}
+		expect(t, v, want...)
+		expectNothing(t, v)
+	}
+}
+
+// A reloaded sender has a new RTCPeerConnection: it must not be handed the
+// answer to its old tab's offer, and its fresh offer must reach the viewer.
+func TestSenderRejoinGetsNoStaleAnswer(t *testing.T) {
+	s, url := newTestServer(t)
+	v := join(t, url, "viewer", "s1")
+	s1 := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "both attached", func(ep *endpoint) bool { return ep.sender != nil && ep.viewer != nil })
+
+	send(t, s1, msg{Type: "offer", SDP: "O1"})
+	expect(t, v, msg{Type: "offer", SDP: "O1"})
+	send(t, v, msg{Type: "answer", SDP: "A1"})
+	expect(t, s1, msg{Type: "answer", SDP: "A1"})
+
+	s1.Close()
+	waitFor(t, s, "s1", "the sender left", func(ep *endpoint) bool { return ep.sender == nil })
+	s2 := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "the new sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+	expectNothing(t, s2)
+
+	send(t, s2, msg{Type: "offer", SDP: "O2"})
+	expect(t, v, msg{Type: "offer", SDP: "O2"})
+	send(t, v, msg{Type: "answer", SDP: "A2"})
+	expect(t, s2, msg{Type: "answer", SDP: "A2"})
+}
+
+// An answer and ICE the viewer sent for a sender tab that has since gone are
+// dropped rather than replayed to the sender's next tab.
+func TestSenderRejoinDropsQueuedAnswer(t *testing.T) {
+	s, url := newTestServer(t)
+	s1 := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "the sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+	send(t, s1, msg{Type: "offer", SDP: "O1"})
+	waitFor(t, s, "s1", "the offer queued", func(ep *endpoint) bool { return ep.offer != nil })
+	s1.Close()
+	waitFor(t, s, "s1", "the sender left", func(ep *endpoint) bool { return ep.sender == nil })
+
+	v := join(t, url, "viewer", "s1")
+	expect(t, v, msg{Type: "offer", SDP: "O1"})
+	send(t, v, msg{Type: "answer", SDP: "A1"})
+	send(t, v, msg{Type: "ice", Cand: cand("v1")})
+	waitFor(t, s, "s1", "the answer queued", func(ep *endpoint) bool { return ep.answer != nil && len(ep.iceFromViewer) == 1 })
+
+	s2 := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "the new sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+	expectNothing(t, s2)
+}
+
+// A reloaded viewer can't use the offer its old tab answered, so the sender is
+// asked for a fresh one, which reaches the new viewer.
+func TestViewerRejoinRestartsSender(t *testing.T) {
+	s, url := newTestServer(t)
+	snd := join(t, url, "sender", "s1")
+	v1 := join(t, url, "viewer", "s1")
+	waitFor(t, s, "s1", "both attached", func(ep *endpoint) bool { return ep.sender != nil && ep.viewer != nil })
+
+	send(t, snd, msg{Type: "offer", SDP: "O1"})
+	expect(t, v1, msg{Type: "offer", SDP: "O1"})
+	send(t, v1, msg{Type: "answer", SDP: "A1"})
+	expect(t, snd, msg{Type: "answer", SDP: "A1"})
+
+	v1.Close()
+	waitFor(t, s, "s1", "the viewer left", func(ep *endpoint) bool { return ep.viewer == nil })
+	v2 := join(t, url, "viewer", "s1")
+	expect(t, snd, msg{Type: "restart"})
+	expectNothing(t, v2)
+
+	send(t, snd, msg{Type: "offer", SDP: "O2"})
+	expect(t, v2, msg{Type: "offer", SDP: "O2"})
+}
+
+// /end hangs up only for a caller presenting VIDEO_END_TOKEN, and is refused
+// outright while no token is configured.
+func TestEndRequiresToken(t *testing.T) {
+	s, url := newTestServer(t)
+	snd := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "the sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+
+	end := func(auth string) int {
+		req := httptest.NewRequest(http.MethodPost, "/end?sid=s1", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		rec := httptest.NewRecorder()
+		s.end(rec, req)
+		return rec.Code
+	}
+	t.Setenv("VIDEO_END_TOKEN", "")
+	if code := end(""); code != http.StatusForbidden {
+		t.Fatalf("no token configured: got %d, want 403", code)
+	}
+	t.Setenv("VIDEO_END_TOKEN", "secret")
+	if code := end("Bearer wrong"); code != http.StatusForbidden {
+		t.Fatalf("wrong token: got %d, want 403", code)
+	}
+	if code := end("Bearer secret"); code != http.StatusNoContent {
+		t.Fatalf("right token: got %d, want 204", code)
+	}
+	select {
+	case _, ok := <-snd.in:
+		if ok {
+			t.Fatal("sender got a message instead of a close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("sender's connection wasn't closed")
+	}
+}
+
+// /active tells chat whether anyone is still connected to a session, so it
+// can stop counting calls whose tabs have all closed.
+func TestActiveReportsConnectedSessions(t *testing.T) {
+	s, url := newTestServer(t)
+	t.Setenv("VIDEO_END_TOKEN", "secret")
+	active := func(auth string) int {
+		req := httptest.NewRequest(http.MethodGet, "/active?sid=s1", nil)
+		req.Header.Set("Authorization", auth)
+		rec := httptest.NewRecorder()
+		s.active(rec, req)
+		return rec.Code
+	}
+	if code := active("Bearer secret"); code != http.StatusNotFound {
+		t.Fatalf("unknown session: got %d, want 404", code)
+	}
+	snd := join(t, url, "sender", "s1")
+	waitFor(t, s, "s1", "the sender attached", func(ep *endpoint) bool { return ep.sender != nil })
+	if code := active("Bearer wrong"); code != http.StatusForbidden {
+		t.Fatalf("wrong token: got %d, want 403", code)
+	}
+	if code := active("Bearer secret"); code != http.StatusNoContent {
+		t.Fatalf("connected session: got %d, want 204", code)
+	}
+	snd.Close()
+	waitFor(t, s, "s1", "the sender left", func(ep *endpoint) bool { return ep.sender == nil })
+	if code := active("Bearer secret"); code != http.StatusNotFound {
+		t.Fatalf("abandoned session: got %d, want 404", code)
+	}
+}
+
+// Either "peer" may offer: the first one's offer and ICE wait for the second,
+// the answer goes back, and a later offer from the second side is relayed the
+// other way. A third peer is turned away.
+func TestPeersExchangeSymmetrically(t *testing.T) {
+	s, url := newTestServer(t)
+	a := join(t, url, "peer", "s1")
+	waitFor(t, s, "s1", "the first peer attached", func(ep *endpoint) bool { return ep.peers[0] != nil })
+	send(t, a, msg{Type: "offer", SDP: "OA"})
+	send(t, a, msg{Type: "ice", Cand: cand("a1")})
+	waitFor(t, s, "s1", "the offer queued", func(ep *endpoint) bool { return len(ep.peerQueue[0]) == 2 })
+
+	b := join(t, url, "peer", "s1")
+	expect(t, b, msg{Type: "offer", SDP: "OA"}, msg{Type: "ice", Cand: cand("a1")})
+	send(t, b, msg{Type: "answer", SDP: "AB"})
+	send(t, b, msg{Type: "ice", Cand: cand("b1")})
+	expect(t, a, msg{Type: "answer", SDP: "AB"}, msg{Type: "ice", Cand: cand("b1")})
+
+	send(t, b, msg{Type: "offer", SDP: "OB"})
+	expect(t, a, msg{Type: "offer", SDP: "OB"})
+	send(t, a, msg{Type: "answer", SDP: "AA"})
+	expect(t, b, msg{Type: "answer", SDP: "AA"})
+	expectNothing(t, a)
+	expectNothing(t, b)
+
+	c := join(t, url, "peer", "s1")
+	select {
+	case _, ok := <-c.in:
+		if ok {
+			t.Fatal("third peer got a message instead of a close")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("third peer wasn't turned away")
+	}
+}
+
+func TestCalleeReloadRestartsCaller(t *testing.T) {
+	s, url := newTestServer(t)
+	caller := join(t, url, "caller", "s1")
+	callee := join(t, url, "callee", "s1")
+	waitFor(t, s, "s1", "both sides attached", func(ep *endpoint) bool { return ep.peers[0] != nil && ep.peers[1] != nil })
+	send(t, caller, msg{Type: "offer", SDP: "O1"})
+	expect(t, callee, msg{Type: "offer", SDP: "O1"})
+	send(t, callee, msg{Type: "answer", SDP: "A1"})
+	expect(t, caller, msg{Type: "answer", SDP: "A1"})
+
+	_ = callee.Close()
+	waitFor(t, s, "s1", "the callee detached", func(ep *endpoint) bool { return ep.peers[1] == nil })
+	send(t, caller, msg{Type: "ice", Cand: cand("c1")}) // queued for the old callee
+	waitFor(t, s, "s1", "the candidate queued", func(ep *endpoint) bool { return len(ep.peerQueue[0]) == 1 })
+
+	callee = join(t, url, "callee", "s1")
+	expect(t, caller, msg{Type: "restart"})
+	expectNothing(t, callee)
+	send(t, caller, msg{Type: "offer", SDP: "O2"})
+	expect(t, callee, msg{Type: "offer", SDP: "O2"})
+}
+
+func TestCallerReloadGetsNoStaleQueue(t *testing.T) {
+	s, url := newTestServer(t)
+	caller := join(t, url, "caller", "s1")
+	callee := join(t, url, "callee", "s1")
+	waitFor(t, s, "s1", "both sides attached", func(ep *endpoint) bool { return ep.peers[0] != nil && ep.peers[1] != nil })
+
+	_ = caller.Close()
+	waitFor(t, s, "s1", "the caller detached", func(ep *endpoint) bool { return ep.peers[0] == nil })
+	send(t, callee, msg{Type: "ice", Cand: cand("e1")}) // queued for the old caller
+	waitFor(t, s, "s1", "the candidate queued", func(ep *endpoint) bool { return len(ep.peerQueue[1]) == 1 })
+
+	caller = join(t, url, "caller", "s1")
+	expect(t, callee, msg{Type: "restart"})
+	expectNothing(t, caller)
+}